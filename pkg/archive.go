@@ -0,0 +1,109 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type ArchiveFormat int
+
+const (
+	unknownArchiveFormat ArchiveFormat = iota
+	archiveZip
+	archiveTar
+	archiveTarGzip
+)
+
+// getArchiveFormat identifies an archive's format from its magic bytes.
+func getArchiveFormat(archive []byte) ArchiveFormat {
+	switch {
+	case bytes.HasPrefix(archive, []byte("PK\x03\x04")), bytes.HasPrefix(archive, []byte("PK\x05\x06")):
+		return archiveZip
+	case bytes.HasPrefix(archive, []byte("\x1f\x8b")) && isTarGzip(archive):
+		return archiveTarGzip
+	case isTar(archive):
+		return archiveTar
+	}
+	return unknownArchiveFormat
+}
+
+// isTar checks for the "ustar" magic of POSIX and GNU tar headers.
+func isTar(archive []byte) bool {
+	return len(archive) >= 262 && string(archive[257:262]) == "ustar"
+}
+
+// isTarGzip checks for a tar header at the start of a gzip stream.
+func isTarGzip(archive []byte) bool {
+	gr, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return false
+	}
+	defer gr.Close()
+	header := make([]byte, 262)
+	n, _ := io.ReadFull(gr, header)
+	return isTar(header[:n])
+}
+
+// walkArchive calls fn for each regular file within the archive.
+func walkArchive(archive []byte, fn func(name string, r io.Reader) error) error {
+	switch getArchiveFormat(archive) {
+	case archiveZip:
+		zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+		if err != nil {
+			return err
+		}
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			reader, err := f.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(f.Name, reader)
+			reader.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case archiveTarGzip:
+		gr, err := gzip.NewReader(bytes.NewReader(archive))
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		return walkTar(gr, fn)
+	case archiveTar:
+		return walkTar(bytes.NewReader(archive), fn)
+	}
+	magic := archive
+	if len(magic) > 4 {
+		magic = magic[:4]
+	}
+	return fmt.Errorf("%w [magic=%q]", ErrUnsupportedArchive, magic)
+}
+
+func walkTar(r io.Reader, fn func(name string, r io.Reader) error) error {
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(strings.TrimPrefix(h.Name, "./"), tr); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+var archiveFiles = map[string]string{
+	"pkg-1.0-py3-none-any.whl": "wheel contents",
+	"pkg-1.0.tar.gz":           "sdist contents",
+	"dist/pkg-1.0.zip":         "nested contents",
+}
+
+func tarArchive(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "./dist/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: "./" + name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipArchive(t *testing.T, archive []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(archive); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestWalkArchive(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		archive []byte
+		format  ArchiveFormat
+	}{
+		{"zip", zipArchive(t, archiveFiles), archiveZip},
+		{"tar", tarArchive(t, archiveFiles), archiveTar},
+		{"tar.gz", gzipArchive(t, tarArchive(t, archiveFiles)), archiveTarGzip},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if format := getArchiveFormat(tc.archive); format != tc.format {
+				t.Errorf("getArchiveFormat() = %v, want %v", format, tc.format)
+			}
+			got := make(map[string]string)
+			err := walkArchive(tc.archive, func(name string, r io.Reader) error {
+				content, err := ioutil.ReadAll(r)
+				if err != nil {
+					return err
+				}
+				got[name] = string(content)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("walkArchive() = %v", err)
+			}
+			if !reflect.DeepEqual(got, archiveFiles) {
+				t.Errorf("walkArchive() yielded %v, want %v", got, archiveFiles)
+			}
+		})
+	}
+}
+
+func TestWalkArchiveUnsupported(t *testing.T) {
+	for _, archive := range [][]byte{
+		nil,
+		[]byte("plain text"),
+		[]byte("BZh91AY&SY"),
+		gzipArchive(t, []byte("plain text")),
+		gzipArchive(t, zipArchive(t, archiveFiles)),
+		[]byte("\x1f\x8b not gzip"),
+	} {
+		err := walkArchive(archive, func(string, io.Reader) error {
+			t.Error("walkArchive() called fn for an unsupported archive")
+			return nil
+		})
+		if !errors.Is(err, ErrUnsupportedArchive) {
+			t.Errorf("walkArchive(%q) = %v, want %v", archive, err, ErrUnsupportedArchive)
+		}
+	}
+}
+
+func TestWalkArchiveError(t *testing.T) {
+	stop := errors.New("stop")
+	for _, archive := range [][]byte{zipArchive(t, archiveFiles), tarArchive(t, archiveFiles)} {
+		var calls int
+		err := walkArchive(archive, func(string, io.Reader) error {
+			calls++
+			return stop
+		})
+		if !errors.Is(err, stop) || calls != 1 {
+			t.Errorf("walkArchive() = %v after %d calls, want %v after 1", err, calls, stop)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// batchLease is how long a batch job may hold a claim on a version before
+// another invocation may take it over.
+const batchLease = time.Hour
+
+// BatchProgress summarizes the state of a batch rebuild job.
+type BatchProgress struct {
+	Job       string `json:"job"`
+	Package   string `json:"package"`
+	Total     int    `json:"total"`
+	Succeeded int    `json:"succeeded"`
+	Failed    int    `json:"failed"`
+	Pending   int    `json:"pending"`
+	// Versions maps each attempted version to its rebuild status.
+	Versions map[string]string `json:"versions"`
+}
+
+// HandleBatchRebuild rebuilds every released version of a package.
+//
+// Progress is checkpointed to the job's document after each version so that
+// an interrupted job can be resumed by re-invoking it with the same `job`
+// parameter (by default, the package name). Versions that were previously
+// rebuilt, or that already have an attestation, are skipped. Each version is
+// claimed before it is rebuilt so that concurrent invocations of the same job
+// don't rebuild it twice.
+func HandleBatchRebuild(rw http.ResponseWriter, req *http.Request) {
+	ctx := context.Background()
+	gh := githubClient(*githubToken)
+	req.ParseForm()
+	scope, pkg, ref, job := req.Form.Get("scope"), req.Form.Get("pkg"), req.Form.Get("ref"), req.Form.Get("job")
+	if ref == "" {
+		ref = "main"
+	}
+	if job == "" {
+		job = pkg
+	}
+	policy, err := fetchPolicy(&gh, scope, pkg, ref)
+	if err != nil {
+		log.Println(err)
+		code, msg := errorResponse(err, "Failed to fetch policy")
+		http.Error(rw, msg, code)
+		return
+	}
+	if policy.Rebuilder == nil {
+		http.Error(rw, "Policy does not define rebuilder", 400)
+		return
+	}
+	client, err := firestore.NewClient(ctx, *project)
+	if err != nil {
+		http.Error(rw, "Internal Error", 500)
+		return
+	}
+	versions := releasedVersions(pypiMetadata(pkg))
+	jobRef := client.Collection("batches").Doc(job)
+	_, err = jobRef.Set(ctx, map[string]interface{}{
+		"package":        pkg,
+		"policy_version": policy.Digest,
+		"total":          len(versions),
+		"updated_time":   time.Now(),
+	}, firestore.MergeAll)
+	if err != nil {
+		http.Error(rw, "Internal Error", 500)
+		return
+	}
+	attested := func(version string) bool {
+		_, err := client.Collection("attestations").Doc(pkg + "!" + version).Get(ctx)
+		return err == nil
+	}
+	rebuild := func(version string) (map[string]interface{}, error) {
+		record, err := rebuildVersion(ctx, client, policy, pkg, version)
+		if _, _, err := client.Collection("rebuilds").Add(ctx, record); err != nil {
+			log.Println("Failed to write record")
+		}
+		return record, err
+	}
+	if err := runBatch(pkg, versions, firestoreCheckpoint{ctx, client, jobRef, pkg}, attested, rebuild); err != nil {
+		log.Println(err)
+		http.Error(rw, "Failed to checkpoint batch", 500)
+		return
+	}
+	writeBatchProgress(ctx, rw, client, job)
+}
+
+// batchCheckpoint records the outcome of each version of a batch job.
+type batchCheckpoint interface {
+	// Claim atomically marks a version as in progress, reporting false if it
+	// has already succeeded or is claimed by another invocation.
+	Claim(version string) (bool, error)
+	Save(version string, record map[string]interface{}) error
+}
+
+// claimRecord returns the record marking a version as claimed until expiry.
+func claimRecord(pkg, version string, expiry time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"package":      pkg,
+		"version":      version,
+		"status":       "in_progress",
+		"lease_expiry": expiry,
+	}
+}
+
+// claimable reports whether a version with the recorded status may be claimed:
+// it must not have succeeded nor be held by an unexpired claim.
+func claimable(record map[string]interface{}, now time.Time) bool {
+	switch record["status"] {
+	case "success":
+		return false
+	case "in_progress":
+		expiry, _ := record["lease_expiry"].(time.Time)
+		return !now.Before(expiry)
+	}
+	return true
+}
+
+// runBatch attempts each version that wasn't previously rebuilt and records
+// its outcome before moving on. Versions that already have an attestation are
+// recorded as successful without being rebuilt. Rebuild errors are recorded
+// rather than returned so that a bad version can't block the rest of the job.
+func runBatch(pkg string, versions []string, cp batchCheckpoint, attested func(version string) bool, rebuild func(version string) (map[string]interface{}, error)) error {
+	for _, version := range versions {
+		claimed, err := cp.Claim(version)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+		var record map[string]interface{}
+		if attested(version) {
+			record = map[string]interface{}{
+				"package": pkg,
+				"version": version,
+				"status":  "success",
+				"message": "Already attested",
+			}
+		} else {
+			var err error
+			record, err = rebuild(version)
+			if err != nil {
+				log.Printf("Batch rebuild failed [pkg=%s version=%s]: %v", pkg, version, err)
+			}
+		}
+		if err := cp.Save(version, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// firestoreCheckpoint stores the records of a batch job's versions in the
+// job document's "versions" collection.
+type firestoreCheckpoint struct {
+	ctx    context.Context
+	client *firestore.Client
+	job    *firestore.DocumentRef
+	pkg    string
+}
+
+func (f firestoreCheckpoint) versionRef(version string) *firestore.DocumentRef {
+	// The docref doubles as the idempotency key for the version.
+	return f.job.Collection("versions").Doc(f.pkg + "!" + version)
+}
+
+func (f firestoreCheckpoint) Claim(version string) (bool, error) {
+	ref := f.versionRef(version)
+	var claimed bool
+	err := f.client.RunTransaction(f.ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		claimed = false
+		now := time.Now()
+		claim := claimRecord(f.pkg, version, now.Add(batchLease))
+		snapshot, err := tx.Get(ref)
+		switch {
+		case status.Code(err) == codes.NotFound:
+			claimed = true
+			return tx.Create(ref, claim)
+		case err != nil:
+			return err
+		case !claimable(snapshot.Data(), now):
+			return nil
+		}
+		claimed = true
+		return tx.Set(ref, claim)
+	})
+	return claimed, err
+}
+
+func (f firestoreCheckpoint) Save(version string, record map[string]interface{}) error {
+	if _, err := f.versionRef(version).Set(f.ctx, record); err != nil {
+		return err
+	}
+	if _, err := f.job.Update(f.ctx, []firestore.Update{{Path: "updated_time", Value: time.Now()}}); err != nil {
+		log.Println(err)
+	}
+	return nil
+}
+
+// HandleBatchProgress reports the progress of a batch rebuild job.
+func HandleBatchProgress(rw http.ResponseWriter, req *http.Request) {
+	ctx := context.Background()
+	req.ParseForm()
+	job := req.Form.Get("job")
+	if job == "" {
+		job = req.Form.Get("pkg")
+	}
+	client, err := firestore.NewClient(ctx, *project)
+	if err != nil {
+		http.Error(rw, "Internal Error", 500)
+		return
+	}
+	writeBatchProgress(ctx, rw, client, job)
+}
+
+func writeBatchProgress(ctx context.Context, rw http.ResponseWriter, client *firestore.Client, job string) {
+	jobRef := client.Collection("batches").Doc(job)
+	snapshot, err := jobRef.Get(ctx)
+	if err != nil {
+		http.Error(rw, "Not Found", 404)
+		return
+	}
+	docs, err := jobRef.Collection("versions").Documents(ctx).GetAll()
+	if err != nil {
+		http.Error(rw, "Internal Error", 500)
+		return
+	}
+	progress := BatchProgress{
+		Job:      job,
+		Package:  snapshot.Data()["package"].(string),
+		Total:    int(snapshot.Data()["total"].(int64)),
+		Versions: make(map[string]string, len(docs)),
+	}
+	for _, doc := range docs {
+		status := doc.Data()["status"].(string)
+		progress.Versions[doc.Data()["version"].(string)] = status
+		switch status {
+		case "success":
+			progress.Succeeded++
+		case "in_progress":
+			// Counted as pending.
+		default:
+			progress.Failed++
+		}
+	}
+	progress.Pending = progress.Total - progress.Succeeded - progress.Failed
+	ret, err := json.Marshal(progress)
+	if err != nil {
+		http.Error(rw, "Internal Error", 500)
+		return
+	}
+	rw.Write(ret)
+}
+
+// releasedVersions returns the versions with release files in the order in
+// which they were first uploaded.
+func releasedVersions(proj PyPiProject) []string {
+	uploaded := make(map[string]time.Time, len(proj.Releases))
+	var versions []string
+	for version, releases := range proj.Releases {
+		if len(releases) == 0 {
+			continue
+		}
+		first := releases[0].UploadTime
+		for _, r := range releases {
+			if r.UploadTime.Before(first) {
+				first = r.UploadTime
+			}
+		}
+		uploaded[version] = first
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return uploaded[versions[i]].Before(uploaded[versions[j]]) })
+	return versions
+}
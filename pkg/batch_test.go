@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReleasedVersions(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2021, 11, d, 0, 0, 0, 0, time.UTC) }
+	proj := PyPiProject{Releases: map[string][]Release{
+		"1.10": {{Filename: "pkg-1.10.tar.gz", UploadTime: day(20)}},
+		"1.2": {
+			{Filename: "pkg-1.2-py3-none-any.whl", UploadTime: day(15)},
+			// Files uploaded after the fact don't affect the order.
+			{Filename: "pkg-1.2.tar.gz", UploadTime: day(5)},
+		},
+		"1.0":   {{Filename: "pkg-1.0.tar.gz", UploadTime: day(1)}},
+		"1.1":   {{Filename: "pkg-1.1.tar.gz", UploadTime: day(10)}},
+		"2.0a1": {{Filename: "pkg-2.0a1.tar.gz", UploadTime: day(25)}},
+		// Yanked or deleted releases have no files.
+		"0.9": {},
+	}}
+	want := []string{"1.0", "1.2", "1.1", "1.10", "2.0a1"}
+	if got := releasedVersions(proj); !reflect.DeepEqual(got, want) {
+		t.Errorf("releasedVersions() = %v, want %v", got, want)
+	}
+}
+
+// memoryCheckpoint records batch progress in memory as of now, optionally
+// failing to save a version to simulate an interrupted job.
+type memoryCheckpoint struct {
+	records map[string]map[string]interface{}
+	failOn  string
+	now     time.Time
+}
+
+func (m *memoryCheckpoint) Claim(version string) (bool, error) {
+	if r, ok := m.records[version]; ok && !claimable(r, m.now) {
+		return false, nil
+	}
+	m.records[version] = claimRecord("pkg", version, m.now.Add(batchLease))
+	return true, nil
+}
+
+func (m *memoryCheckpoint) Status(version string) string {
+	if r, ok := m.records[version]; ok {
+		return r["status"].(string)
+	}
+	return ""
+}
+
+func (m *memoryCheckpoint) Save(version string, record map[string]interface{}) error {
+	if version == m.failOn {
+		return errors.New("checkpoint failed")
+	}
+	m.records[version] = record
+	return nil
+}
+
+func TestRunBatchResumes(t *testing.T) {
+	versions := []string{"1.0", "1.1", "1.2", "1.3", "1.4"}
+	attestations := map[string]bool{"1.3": true}
+	var rebuilt []string
+	rebuild := func(version string) (map[string]interface{}, error) {
+		rebuilt = append(rebuilt, version)
+		record := map[string]interface{}{"package": "pkg", "version": version, "status": "success"}
+		if version == "1.1" {
+			record["status"] = "error"
+			return record, fmt.Errorf("%w [pkg=pkg, file=pkg-1.1-py3-none-any.whl]", ErrUnsupportedGenerator)
+		}
+		attestations[version] = true
+		return record, nil
+	}
+	attested := func(version string) bool { return attestations[version] }
+	now := time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC)
+	cp := &memoryCheckpoint{records: make(map[string]map[string]interface{}), failOn: "1.2", now: now}
+
+	// The first run is interrupted while saving 1.2, after it was attested.
+	if err := runBatch("pkg", versions, cp, attested, rebuild); err == nil {
+		t.Fatal("runBatch() succeeded, want checkpoint error")
+	}
+	if want := []string{"1.0", "1.1", "1.2"}; !reflect.DeepEqual(rebuilt, want) {
+		t.Errorf("First run rebuilt %v, want %v", rebuilt, want)
+	}
+	if got := cp.Status("1.1"); got != "error" {
+		t.Errorf("Status(1.1) = %q, want %q", got, "error")
+	}
+	if got := cp.Status("1.2"); got != "in_progress" {
+		t.Errorf("Status(1.2) = %q, want %q", got, "in_progress")
+	}
+
+	// On resume after the interrupted claim expired, 1.0 is skipped, the
+	// failed 1.1 is retried without blocking the job and 1.2 and 1.3 are
+	// recognized as already attested.
+	rebuilt = nil
+	cp.failOn = ""
+	cp.now = now.Add(batchLease)
+	if err := runBatch("pkg", versions, cp, attested, rebuild); err != nil {
+		t.Fatalf("runBatch() = %v", err)
+	}
+	if want := []string{"1.1", "1.4"}; !reflect.DeepEqual(rebuilt, want) {
+		t.Errorf("Resumed run rebuilt %v, want %v", rebuilt, want)
+	}
+	for version, want := range map[string]string{"1.0": "success", "1.1": "error", "1.2": "success", "1.3": "success", "1.4": "success"} {
+		if got := cp.Status(version); got != want {
+			t.Errorf("Status(%s) = %q, want %q", version, got, want)
+		}
+	}
+	if msg := cp.records["1.3"]["message"]; msg != "Already attested" {
+		t.Errorf("Record for 1.3 has message %q, want %q", msg, "Already attested")
+	}
+
+	// Once complete, re-running only retries the failed version.
+	rebuilt = nil
+	if err := runBatch("pkg", versions, cp, attested, rebuild); err != nil {
+		t.Fatalf("runBatch() = %v", err)
+	}
+	if want := []string{"1.1"}; !reflect.DeepEqual(rebuilt, want) {
+		t.Errorf("Repeated run rebuilt %v, want %v", rebuilt, want)
+	}
+}
+
+func TestRunBatchSkipsClaimed(t *testing.T) {
+	now := time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC)
+	cp := &memoryCheckpoint{records: map[string]map[string]interface{}{
+		// Claimed by a concurrent invocation of the job.
+		"1.0": claimRecord("pkg", "1.0", now.Add(time.Minute)),
+		// Claimed by an invocation that was interrupted.
+		"1.1": claimRecord("pkg", "1.1", now.Add(-time.Minute)),
+	}, now: now}
+	var rebuilt []string
+	rebuild := func(version string) (map[string]interface{}, error) {
+		rebuilt = append(rebuilt, version)
+		return map[string]interface{}{"package": "pkg", "version": version, "status": "success"}, nil
+	}
+	attested := func(string) bool { return false }
+	if err := runBatch("pkg", []string{"1.0", "1.1", "1.2"}, cp, attested, rebuild); err != nil {
+		t.Fatalf("runBatch() = %v", err)
+	}
+	if want := []string{"1.1", "1.2"}; !reflect.DeepEqual(rebuilt, want) {
+		t.Errorf("runBatch() rebuilt %v, want %v", rebuilt, want)
+	}
+	if got := cp.Status("1.0"); got != "in_progress" {
+		t.Errorf("Status(1.0) = %q, want %q", got, "in_progress")
+	}
+}
+
+func TestClaimable(t *testing.T) {
+	now := time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name   string
+		record map[string]interface{}
+		want   bool
+	}{
+		{"success", map[string]interface{}{"status": "success"}, false},
+		{"error", map[string]interface{}{"status": "error"}, true},
+		{"failure", map[string]interface{}{"status": "failure"}, true},
+		{"claimed", claimRecord("pkg", "1.0", now.Add(time.Second)), false},
+		{"claim expired", claimRecord("pkg", "1.0", now), true},
+		{"claim without expiry", map[string]interface{}{"status": "in_progress"}, true},
+	} {
+		if got := claimable(tc.record, now); got != tc.want {
+			t.Errorf("claimable(%s) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -2,8 +2,18 @@ package main
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
 	"fmt"
+	"hash"
+	"sync"
 
 	kms "cloud.google.com/go/kms/apiv1"
 	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
@@ -26,8 +36,7 @@ type Signature struct {
 
 func NewDSSE(payload []byte) (DSSE, error) {
 	encodedPayload := base64.StdEncoding.EncodeToString(payload)
-	encoded := fmt.Sprintf("DSSEv1 %d %s %d %s", len(inTotoPayloadType), inTotoPayloadType, len(encodedPayload), encodedPayload)
-	sig, err := kmsSign(*kmsKey, []byte(encoded))
+	sig, err := kmsSign(*kmsKey, preAuthEncoding(inTotoPayloadType, encodedPayload))
 	if err != nil {
 		return DSSE{}, err
 	}
@@ -41,6 +50,123 @@ func NewDSSE(payload []byte) (DSSE, error) {
 	}, nil
 }
 
+// VerifyDSSE checks that the envelope carries an in-toto payload signed by the
+// configured KMS key.
+func VerifyDSSE(dsse DSSE) error {
+	pub, err := kmsPublicKey(*kmsKey)
+	if err != nil {
+		return err
+	}
+	return verifyEnvelope(dsse, "https://cloudkms.googleapis.com/"+*kmsKey, pub)
+}
+
+// verifyEnvelope checks that the envelope carries an in-toto payload with a
+// signature from keyID that is valid for the public key.
+func verifyEnvelope(dsse DSSE, keyID string, pub crypto.PublicKey) error {
+	if dsse.PayloadType != inTotoPayloadType {
+		return fmt.Errorf("%w [type=%s]", ErrUnsupportedPayloadType, dsse.PayloadType)
+	}
+	if _, err := base64.StdEncoding.DecodeString(dsse.Payload); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedDSSE, err)
+	}
+	encoded := preAuthEncoding(dsse.PayloadType, dsse.Payload)
+	for _, s := range dsse.Signatures {
+		if s.KeyID != keyID {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(s.Sig)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrMalformedDSSE, err)
+		}
+		ok, err := verifySignature(pub, encoded, sig)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w [keyid=%s]", ErrInvalidSignature, keyID)
+}
+
+// preAuthEncoding returns the message signed for a DSSE envelope.
+// NOTE: The payload is encoded in its base64 form.
+func preAuthEncoding(payloadType, encodedPayload string) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(encodedPayload), encodedPayload))
+}
+
+// verifySignature reports whether sig is a valid signature of payload using
+// one of the kmsAlgorithms. Keys for which the signing algorithm can't be
+// determined are reported as unsupported rather than as invalid signatures.
+func verifySignature(pub crypto.PublicKey, payload, sig []byte) (bool, error) {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		var h hash.Hash
+		switch k.Curve {
+		case elliptic.P256():
+			h = sha256.New()
+		case elliptic.P384():
+			h = sha512.New384()
+		default:
+			return false, fmt.Errorf("%w [curve=%s]", ErrUnsupportedKeyAlgorithm, k.Curve.Params().Name)
+		}
+		h.Write(payload)
+		return ecdsa.VerifyASN1(k, h.Sum(nil), sig), nil
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(payload)
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil, nil
+	}
+	return false, fmt.Errorf("%w [type=%T]", ErrUnsupportedKeyAlgorithm, pub)
+}
+
+// kmsAlgorithms are the KMS key algorithms whose signatures verifySignature
+// can check. Other algorithms share key types with these (e.g. RSA-PSS or
+// SHA-512 digests) and so must be rejected before verification.
+var kmsAlgorithms = map[kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm]bool{
+	kmspb.CryptoKeyVersion_EC_SIGN_P256_SHA256:        true,
+	kmspb.CryptoKeyVersion_EC_SIGN_P384_SHA384:        true,
+	kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_2048_SHA256: true,
+	kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_3072_SHA256: true,
+	kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_4096_SHA256: true,
+}
+
+var publicKeys = struct {
+	sync.Mutex
+	keys map[string]crypto.PublicKey
+}{keys: make(map[string]crypto.PublicKey)}
+
+func kmsPublicKey(keyName string) (crypto.PublicKey, error) {
+	publicKeys.Lock()
+	defer publicKeys.Unlock()
+	if pub, ok := publicKeys.keys[keyName]; ok {
+		return pub, nil
+	}
+	ctx := context.Background()
+	c, err := kms.NewKeyManagementClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	resp, err := c.GetPublicKey(ctx, &kmspb.GetPublicKeyRequest{Name: keyName})
+	if err != nil {
+		return nil, err
+	}
+	if !kmsAlgorithms[resp.GetAlgorithm()] {
+		return nil, fmt.Errorf("%w [key=%s, algorithm=%s]", ErrUnsupportedKeyAlgorithm, keyName, resp.GetAlgorithm())
+	}
+	block, _ := pem.Decode([]byte(resp.Pem))
+	if block == nil {
+		return nil, fmt.Errorf("Malformed public key PEM [key=%s]", keyName)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	publicKeys.keys[keyName] = pub
+	return pub, nil
+}
+
 func kmsSign(keyName string, payload []byte) ([]byte, error) {
 	ctx := context.Background()
 	c, err := kms.NewKeyManagementClient(ctx)
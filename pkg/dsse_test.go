@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/in-toto/in-toto-golang/in_toto"
+)
+
+const testKeyID = "https://cloudkms.googleapis.com/projects/test/cryptoKeyVersions/1"
+
+// signedEnvelope returns a DSSE envelope for the statement signed as NewDSSE
+// would, but using the provided key in place of KMS.
+func signedEnvelope(t *testing.T, key *ecdsa.PrivateKey, stmt in_toto.ProvenanceStatement) DSSE {
+	t.Helper()
+	payload, err := in_toto.EncodeCanonical(stmt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedPayload := base64.StdEncoding.EncodeToString(payload)
+	digest := sha256.Sum256(preAuthEncoding(inTotoPayloadType, encodedPayload))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return DSSE{
+		PayloadType: inTotoPayloadType,
+		Payload:     encodedPayload,
+		Signatures:  []Signature{{KeyID: testKeyID, Sig: base64.StdEncoding.EncodeToString(sig)}},
+	}
+}
+
+func testStatement(name, digest string) in_toto.ProvenanceStatement {
+	stmt := in_toto.ProvenanceStatement{}
+	stmt.Type = "https://in-toto.io/Statement/v0.1"
+	stmt.PredicateType = "https://slsa.dev/provenance/v0.1"
+	stmt.Subject = []in_toto.Subject{{Name: name, Digest: in_toto.DigestSet{"sha256": digest}}}
+	stmt.Predicate.Builder.ID = "https://demo.slsa.dev/rebuilder@v1"
+	return stmt
+}
+
+func TestVerifyEnvelope(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p521, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519Pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt := testStatement("idna-3.3-py3-none-any.whl", "84d9dd047ffa80596e0f246e2eab0b391788b0503584e8945f2368256d2735ff")
+	tampered, err := in_toto.EncodeCanonical(testStatement("idna-3.3-py3-none-any.whl", "0000000000000000000000000000000000000000000000000000000000000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		mutate func(*DSSE)
+		pub    crypto.PublicKey
+		err    error
+		code   int
+	}{
+		{
+			name:   "valid",
+			mutate: func(*DSSE) {},
+			pub:    &key.PublicKey,
+		},
+		{
+			name:   "payload changed after signing",
+			mutate: func(d *DSSE) { d.Payload = base64.StdEncoding.EncodeToString(tampered) },
+			pub:    &key.PublicKey,
+			err:    ErrInvalidSignature,
+			code:   400,
+		},
+		{
+			name:   "wrong payload type",
+			mutate: func(d *DSSE) { d.PayloadType = "application/json" },
+			pub:    &key.PublicKey,
+			err:    ErrUnsupportedPayloadType,
+			code:   422,
+		},
+		{
+			name:   "signed by another key",
+			mutate: func(*DSSE) {},
+			pub:    &other.PublicKey,
+			err:    ErrInvalidSignature,
+			code:   400,
+		},
+		{
+			name:   "signature from another key id",
+			mutate: func(d *DSSE) { d.Signatures[0].KeyID = "https://example.com/key" },
+			pub:    &key.PublicKey,
+			err:    ErrInvalidSignature,
+			code:   400,
+		},
+		{
+			name:   "malformed payload",
+			mutate: func(d *DSSE) { d.Payload = "not base64!" },
+			pub:    &key.PublicKey,
+			err:    ErrMalformedDSSE,
+			code:   422,
+		},
+		{
+			name:   "unsupported curve",
+			mutate: func(*DSSE) {},
+			pub:    &p521.PublicKey,
+			err:    ErrUnsupportedKeyAlgorithm,
+			code:   500,
+		},
+		{
+			name:   "unsupported key type",
+			mutate: func(*DSSE) {},
+			pub:    ed25519Pub,
+			err:    ErrUnsupportedKeyAlgorithm,
+			code:   500,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dsse := signedEnvelope(t, key, stmt)
+			tc.mutate(&dsse)
+			err := verifyEnvelope(dsse, testKeyID, tc.pub)
+			if tc.err == nil {
+				if err != nil {
+					t.Fatalf("verifyEnvelope() = %v, want nil", err)
+				}
+				return
+			}
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("verifyEnvelope() = %v, want %v", err, tc.err)
+			}
+			if code, _ := errorResponse(err, ""); code != tc.code {
+				t.Errorf("errorResponse() code = %d, want %d", code, tc.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrUnsupportedRepo      = errors.New("Non-github repos not yet supported")
+	ErrUnknownPackage       = errors.New("Unknown package")
+	ErrNoWorkflow           = errors.New("No workflow match")
+	ErrUnsupportedArchive   = errors.New("Unsupported archive format")
+	ErrNoArtifacts          = errors.New("No artifacts to rebuild")
+	ErrNoTag                = errors.New("No tag found")
+	ErrNoSetupPy            = errors.New("No setup.py file found in package root")
+	ErrUnsupportedRelease   = errors.New("Release type not supported")
+	ErrUnsupportedPython    = errors.New("No python interpreter available")
+	ErrMalformedWheel       = errors.New("Malformed wheel")
+	ErrUnsupportedGenerator = errors.New("Wheel not built with bdist_wheel")
+	ErrRebuildDiffs         = errors.New("Rebuild contained diffs")
+	ErrBuilderNotAuthorized = errors.New("Builder not authorized")
+	ErrNoSubjects           = errors.New("Statement has no subjects")
+	ErrUnknownSubject       = errors.New("Subject is not a release file")
+	ErrSubjectMismatch      = errors.New("Subject digest does not match release")
+
+	ErrMalformedDSSE           = errors.New("Malformed DSSE")
+	ErrUnsupportedPayloadType  = errors.New("Unsupported payload type")
+	ErrInvalidSignature        = errors.New("Signature verification failed")
+	ErrUnsupportedKeyAlgorithm = errors.New("Unsupported signing key algorithm")
+)
+
+// PermissionError indicates that the GitHub token lacks access to a repo.
+type PermissionError struct {
+	Repo string
+	Err  error
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("Insufficient token permissions [repo=%s]: %v", e.Repo, e.Err)
+}
+
+func (e *PermissionError) Unwrap() error {
+	return e.Err
+}
+
+// errorStatuses maps errors to the HTTP status reported to clients.
+var errorStatuses = []struct {
+	err  error
+	code int
+}{
+	{ErrUnsupportedRepo, 422},
+	{ErrUnknownPackage, 404},
+	{ErrNoWorkflow, 404},
+	{ErrUnsupportedArchive, 422},
+	{ErrNoArtifacts, 404},
+	{ErrNoTag, 404},
+	{ErrNoSetupPy, 404},
+	{ErrUnsupportedRelease, 422},
+	{ErrUnsupportedPython, 422},
+	{ErrMalformedWheel, 422},
+	{ErrUnsupportedGenerator, 422},
+	{ErrRebuildDiffs, 409},
+	{ErrBuilderNotAuthorized, 403},
+	{ErrNoSubjects, 422},
+	{ErrUnknownSubject, 422},
+	{ErrSubjectMismatch, 422},
+	{ErrMalformedDSSE, 422},
+	{ErrUnsupportedPayloadType, 422},
+	{ErrInvalidSignature, 400},
+	{ErrUnsupportedKeyAlgorithm, 500},
+}
+
+// errorResponse returns the HTTP status and message with which to report err.
+// Unrecognized errors are reported as internal errors with the fallback message.
+func errorResponse(err error, fallback string) (int, string) {
+	var perr *PermissionError
+	if errors.As(err, &perr) {
+		return 502, fmt.Sprintf("Insufficient token permissions for %s", perr.Repo)
+	}
+	for _, s := range errorStatuses {
+		if errors.Is(err, s.err) {
+			return s.code, s.err.Error()
+		}
+	}
+	return 500, fallback
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestErrorResponse(t *testing.T) {
+	want := map[error]int{
+		ErrUnsupportedRepo:         422,
+		ErrUnknownPackage:          404,
+		ErrNoWorkflow:              404,
+		ErrUnsupportedArchive:      422,
+		ErrNoArtifacts:             404,
+		ErrNoTag:                   404,
+		ErrNoSetupPy:               404,
+		ErrUnsupportedRelease:      422,
+		ErrUnsupportedPython:       422,
+		ErrMalformedWheel:          422,
+		ErrUnsupportedGenerator:    422,
+		ErrRebuildDiffs:            409,
+		ErrBuilderNotAuthorized:    403,
+		ErrNoSubjects:              422,
+		ErrUnknownSubject:          422,
+		ErrSubjectMismatch:         422,
+		ErrMalformedDSSE:           422,
+		ErrUnsupportedPayloadType:  422,
+		ErrInvalidSignature:        400,
+		ErrUnsupportedKeyAlgorithm: 500,
+	}
+	if len(errorStatuses) != len(want) {
+		t.Errorf("errorStatuses has %d entries, want %d", len(errorStatuses), len(want))
+	}
+	for sentinel, wantCode := range want {
+		for _, err := range []error{
+			sentinel,
+			fmt.Errorf("%w [pkg=idna, version=3.3]", sentinel),
+			fmt.Errorf("Rebuild failed: %w", fmt.Errorf("%w [file=idna-3.3-py3-none-any.whl]", sentinel)),
+		} {
+			code, msg := errorResponse(err, "fallback")
+			if code != wantCode || msg != sentinel.Error() {
+				t.Errorf("errorResponse(%q) = (%d, %q), want (%d, %q)", err, code, msg, wantCode, sentinel.Error())
+			}
+		}
+	}
+}
+
+func TestErrorResponsePermission(t *testing.T) {
+	for _, err := range []error{
+		&PermissionError{Repo: "o/r", Err: errors.New("403 Resource not accessible by integration")},
+		fmt.Errorf("Failed to list runs: %w", &PermissionError{Repo: "o/r", Err: errors.New("403")}),
+		// Permission errors take precedence over the errors they wrap.
+		&PermissionError{Repo: "o/r", Err: fmt.Errorf("%w [repo=o/r]", ErrNoTag)},
+	} {
+		code, msg := errorResponse(err, "fallback")
+		if want := "Insufficient token permissions for o/r"; code != 502 || msg != want {
+			t.Errorf("errorResponse(%q) = (%d, %q), want (502, %q)", err, code, msg, want)
+		}
+	}
+}
+
+func TestErrorResponseFallback(t *testing.T) {
+	for _, err := range []error{
+		errors.New("Rebuild contained diffs"),
+		fmt.Errorf("Failed to rebuild: %v", ErrRebuildDiffs),
+		errors.New("connection reset by peer"),
+	} {
+		if code, msg := errorResponse(err, "fallback"); code != 500 || msg != "fallback" {
+			t.Errorf("errorResponse(%q) = (%d, %q), want (500, %q)", err, code, msg, "fallback")
+		}
+	}
+}
@@ -2,6 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
 
 	"github.com/google/go-github/v40/github"
 	"golang.org/x/oauth2"
@@ -19,3 +23,115 @@ func githubClient(tok string) github.Client {
 		return *github.NewClient(tc)
 	}
 }
+
+// githubError wraps errors from GitHub API calls against a repo, identifying
+// those caused by insufficient token permissions.
+// NOTE: Rate limit errors are also served as 403s but have distinct types.
+func githubError(err error, owner, repo string) error {
+	var rerr *github.ErrorResponse
+	if errors.As(err, &rerr) && rerr.Response != nil && rerr.Response.StatusCode == http.StatusForbidden {
+		return &PermissionError{Repo: owner + "/" + repo, Err: err}
+	}
+	return err
+}
+
+// SourceMetadata records the repository controls that applied to a commit.
+// Fields are "unknown" when the data isn't accessible with the token.
+type SourceMetadata struct {
+	// Branch into which the commit was merged or pushed.
+	Branch          string `json:"branch"`
+	BranchProtected string `json:"branchProtected"`
+	RequiredReviews string `json:"requiredReviews"`
+	// Reviewed is whether the pull request merging the commit was approved.
+	Reviewed string `json:"reviewed"`
+}
+
+// fetchSourceMetadata looks up the pull request that merged a commit and the
+// protection of the branch it was merged into. For commits pushed directly,
+// the protection of the provided branch, if any, is used.
+func fetchSourceMetadata(ctx context.Context, c *github.Client, owner, repo, sha, branch string) SourceMetadata {
+	md := SourceMetadata{Branch: "unknown", BranchProtected: "unknown", RequiredReviews: "unknown", Reviewed: "unknown"}
+	prs, _, err := c.PullRequests.ListPullRequestsWithCommit(ctx, owner, repo, sha, nil)
+	if err != nil {
+		log.Printf("Failed to list pull requests [repo=%s/%s commit=%s]: %v", owner, repo, sha, err)
+		return md
+	}
+	var merged *github.PullRequest
+	for _, pr := range prs {
+		if pr.MergedAt != nil {
+			merged = pr
+			break
+		}
+	}
+	if merged == nil {
+		// Commits pushed directly to a branch are unreviewed.
+		md.Reviewed = "false"
+		if branch == "" {
+			return md
+		}
+	} else {
+		branch = merged.GetBase().GetRef()
+		md.Branch = branch
+		if approved, err := pullRequestApproved(ctx, c, owner, repo, merged.GetNumber()); err == nil {
+			md.Reviewed = strconv.FormatBool(approved)
+		}
+	}
+	b, _, err := c.Repositories.GetBranch(ctx, owner, repo, branch, true)
+	var rerr *github.ErrorResponse
+	switch {
+	case errors.As(err, &rerr) && rerr.Response != nil && rerr.Response.StatusCode == http.StatusNotFound:
+		// Runs triggered by a tag report the tag in place of a branch.
+		log.Printf("Not a branch [repo=%s/%s branch=%s]", owner, repo, branch)
+		return md
+	case err != nil:
+		log.Printf("Failed to get branch [repo=%s/%s branch=%s]: %v", owner, repo, branch, err)
+		return md
+	}
+	md.Branch = branch
+	if !b.GetProtected() {
+		md.BranchProtected = "false"
+		md.RequiredReviews = "0"
+		return md
+	}
+	md.BranchProtected = "true"
+	// NOTE: Reading the protection rules requires admin access to the repo.
+	protection, _, err := c.Repositories.GetBranchProtection(ctx, owner, repo, branch)
+	if err != nil {
+		log.Printf("Failed to get branch protection [repo=%s/%s branch=%s]: %v", owner, repo, branch, err)
+		return md
+	}
+	md.RequiredReviews = "0"
+	if enforcement := protection.GetRequiredPullRequestReviews(); enforcement != nil {
+		md.RequiredReviews = strconv.Itoa(enforcement.RequiredApprovingReviewCount)
+	}
+	return md
+}
+
+// pullRequestApproved reports whether a reviewer's latest review of the pull
+// request approved it. Comments don't affect a reviewer's prior approval.
+func pullRequestApproved(ctx context.Context, c *github.Client, owner, repo string, number int) (bool, error) {
+	states := make(map[int64]string)
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		// Reviews are listed in chronological order.
+		reviews, resp, err := c.PullRequests.ListReviews(ctx, owner, repo, number, opts)
+		if err != nil {
+			return false, err
+		}
+		for _, r := range reviews {
+			if r.GetState() != "COMMENTED" {
+				states[r.GetUser().GetID()] = r.GetState()
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	for _, state := range states {
+		if state == "APPROVED" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v40/github"
+)
+
+// testGitHubClient returns a client whose API requests are served by handler.
+func testGitHubClient(t *testing.T, handler http.Handler) (*github.Client, *httptest.Server) {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	c := github.NewClient(srv.Client())
+	u, err := url.Parse(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.BaseURL = u
+	return c, srv
+}
+
+// servePage returns the page of a paginated request and, unless it's the last
+// of n pages, links to the next page as the GitHub API does.
+func servePage(rw http.ResponseWriter, req *http.Request, n int) int {
+	page, err := strconv.Atoi(req.URL.Query().Get("page"))
+	if err != nil {
+		page = 1
+	}
+	if page < n {
+		next := *req.URL
+		q := next.Query()
+		q.Set("page", strconv.Itoa(page+1))
+		next.RawQuery = q.Encode()
+		rw.Header().Set("Link", fmt.Sprintf(`<http://%s%s>; rel="next"`, req.Host, next.String()))
+	}
+	return page
+}
+
+func TestFetchPolicyPermissionDenied(t *testing.T) {
+	owner, name, dir := *policyRepoOwner, *policyRepoName, *policyRepoDir
+	defer func() { *policyRepoOwner, *policyRepoName, *policyRepoDir = owner, name, dir }()
+	*policyRepoOwner, *policyRepoName, *policyRepoDir = "o", "policies", "."
+	for _, tc := range []struct {
+		name       string
+		header     http.Header
+		body       string
+		permission bool
+		code       int
+	}{
+		{
+			name:       "insufficient permissions",
+			body:       `{"message": "Resource not accessible by integration"}`,
+			permission: true,
+			code:       502,
+		},
+		{
+			name: "rate limited",
+			header: http.Header{
+				"X-Ratelimit-Limit":     []string{"60"},
+				"X-Ratelimit-Remaining": []string{"0"},
+				"X-Ratelimit-Reset":     []string{strconv.Itoa(int(time.Now().Add(time.Hour).Unix()))},
+			},
+			body: `{"message": "API rate limit exceeded"}`,
+			code: 500,
+		},
+		{
+			name: "secondary rate limit",
+			body: `{"message": "You have triggered an abuse detection mechanism.", "documentation_url": "https://docs.github.com/rest/overview/resources-in-the-rest-api#abuse-rate-limits"}`,
+			code: 500,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/repos/o/policies/contents/pypi/idna/policy.yaml", func(rw http.ResponseWriter, req *http.Request) {
+				for k, v := range tc.header {
+					rw.Header()[k] = v
+				}
+				rw.WriteHeader(http.StatusForbidden)
+				rw.Write([]byte(tc.body))
+			})
+			c, _ := testGitHubClient(t, mux)
+			_, err := fetchPolicy(c, "pypi", "idna", "main")
+			if err == nil {
+				t.Fatal("fetchPolicy() succeeded, want error")
+			}
+			var perr *PermissionError
+			switch {
+			case tc.permission && !errors.As(err, &perr):
+				t.Fatalf("fetchPolicy() = %v, want *PermissionError", err)
+			case tc.permission && perr.Repo != "o/policies":
+				t.Errorf("PermissionError.Repo = %q, want %q", perr.Repo, "o/policies")
+			case !tc.permission && errors.As(err, &perr):
+				t.Errorf("fetchPolicy() = %v, want no *PermissionError", err)
+			}
+			code, msg := errorResponse(err, "Failed to fetch policy")
+			if code != tc.code {
+				t.Errorf("errorResponse() = (%d, %q), want code %d", code, msg, tc.code)
+			}
+			if tc.permission && !strings.Contains(msg, "o/policies") {
+				t.Errorf("errorResponse() message %q doesn't name the repo", msg)
+			}
+		})
+	}
+}
+
+func TestFetchSourceMetadata(t *testing.T) {
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+	merged := `[{"number": 1, "merged_at": "2021-11-01T12:00:00Z", "base": {"ref": "main"}}]`
+	review := func(user int, state string) string {
+		return fmt.Sprintf(`{"user": {"id": %d}, "state": %q}`, user, state)
+	}
+	for _, tc := range []struct {
+		name      string
+		branch    string
+		pulls     string
+		reviews   string
+		protected bool
+		want      SourceMetadata
+	}{
+		{
+			name:      "approved pull request",
+			pulls:     merged,
+			reviews:   "[" + review(1, "CHANGES_REQUESTED") + "," + review(1, "APPROVED") + "," + review(1, "COMMENTED") + "]",
+			protected: true,
+			want:      SourceMetadata{Branch: "main", BranchProtected: "true", RequiredReviews: "2", Reviewed: "true"},
+		},
+		{
+			name:      "dismissed approval",
+			pulls:     merged,
+			reviews:   "[" + review(1, "APPROVED") + "," + review(2, "COMMENTED") + "," + review(1, "DISMISSED") + "]",
+			protected: true,
+			want:      SourceMetadata{Branch: "main", BranchProtected: "true", RequiredReviews: "2", Reviewed: "false"},
+		},
+		{
+			name:    "unprotected branch",
+			pulls:   merged,
+			reviews: "[" + review(1, "APPROVED") + "]",
+			want:    SourceMetadata{Branch: "main", BranchProtected: "false", RequiredReviews: "0", Reviewed: "true"},
+		},
+		{
+			name:      "direct push",
+			branch:    "main",
+			pulls:     "[]",
+			protected: true,
+			want:      SourceMetadata{Branch: "main", BranchProtected: "true", RequiredReviews: "2", Reviewed: "false"},
+		},
+		{
+			name:  "direct push to unknown branch",
+			pulls: "[]",
+			want:  SourceMetadata{Branch: "unknown", BranchProtected: "unknown", RequiredReviews: "unknown", Reviewed: "false"},
+		},
+		{
+			name:   "tag push",
+			branch: "v1.0",
+			pulls:  "[]",
+			want:   SourceMetadata{Branch: "unknown", BranchProtected: "unknown", RequiredReviews: "unknown", Reviewed: "false"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/repos/o/r/commits/"+sha+"/pulls", func(rw http.ResponseWriter, req *http.Request) {
+				rw.Write([]byte(tc.pulls))
+			})
+			mux.HandleFunc("/repos/o/r/pulls/1/reviews", func(rw http.ResponseWriter, req *http.Request) {
+				rw.Write([]byte(tc.reviews))
+			})
+			mux.HandleFunc("/repos/o/r/branches/main", func(rw http.ResponseWriter, req *http.Request) {
+				fmt.Fprintf(rw, `{"name": "main", "protected": %v}`, tc.protected)
+			})
+			mux.HandleFunc("/repos/o/r/branches/main/protection", func(rw http.ResponseWriter, req *http.Request) {
+				if !tc.protected {
+					t.Error("Requested protection of an unprotected branch")
+				}
+				rw.Write([]byte(`{"required_pull_request_reviews": {"required_approving_review_count": 2}}`))
+			})
+			mux.HandleFunc("/repos/o/r/branches/v1.0", func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(http.StatusNotFound)
+				rw.Write([]byte(`{"message": "Branch not found"}`))
+			})
+			c, _ := testGitHubClient(t, mux)
+			if got := fetchSourceMetadata(context.Background(), c, "o", "r", sha, tc.branch); got != tc.want {
+				t.Errorf("fetchSourceMetadata() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
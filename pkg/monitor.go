@@ -1,8 +1,6 @@
 package main
 
 import (
-	"archive/zip"
-	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
@@ -23,12 +21,28 @@ import (
 
 type MonitorOptions struct {
 	GitHubActions
-	Version *string
+	Version               *string
+	IncludeSourceMetadata bool
 }
 
-func MonitorBuild(pkg, repo string, opt MonitorOptions) (*in_toto.ProvenanceStatement, error) {
+// MonitorResult describes the CI run from which provenance was generated.
+type MonitorResult struct {
+	Statement in_toto.ProvenanceStatement
+	Version   string
+	Workflow  string
+	RunID     int64
+	Commit    string
+	Branch    string
+	Duration  time.Duration
+	Coverage  ReleaseCoverage
+}
+
+// MonitorBuild finds the CI run that produced the release files of a package
+// version and generates provenance for them. A nil result is returned if no
+// matching run is found.
+func MonitorBuild(pkg, repo string, opt MonitorOptions) (*MonitorResult, error) {
 	if !strings.HasPrefix(repo, "github.com/") {
-		return nil, errors.New("Non-github repos not yet supported")
+		return nil, fmt.Errorf("%w [repo=%s]", ErrUnsupportedRepo, repo)
 	}
 	parts := strings.Split(repo, "/")
 	owner, repo := parts[1], parts[2]
@@ -39,189 +53,306 @@ func MonitorBuild(pkg, repo string, opt MonitorOptions) (*in_toto.ProvenanceStat
 	} else {
 		version = *opt.Version
 	}
-	releasedFiles := make(map[string]time.Time, len(project.Releases[version]))
-	for _, r := range project.Releases[version] {
+	c := githubClient(*githubToken)
+	return monitorBuild(context.Background(), &c, owner, repo, version, project.Releases[version], opt)
+}
+
+// monitorBuild searches the runs of the policy's workflow, newest first, for
+// the one that produced the release files.
+func monitorBuild(ctx context.Context, c *github.Client, owner, repo, version string, releases []Release, opt MonitorOptions) (*MonitorResult, error) {
+	releasedFiles := make(map[string]time.Time, len(releases))
+	for _, r := range releases {
 		releasedFiles[r.Filename] = r.UploadTime
 	}
-	c := githubClient(*githubToken)
-	ctx := context.Background()
-	wfs, _, err := c.Actions.ListWorkflows(ctx, owner, repo, nil)
+	wf, err := findWorkflow(ctx, c, owner, repo, opt.Workflow)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
-	if wfs.GetTotalCount() == 0 {
-		return nil, errors.New("No workflows found")
+	// Runs are walked a page at a time so that large histories needn't be
+	// held in memory.
+	runOpts := &github.ListWorkflowRunsOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		rs, resp, err := c.Actions.ListWorkflowRunsByID(ctx, owner, repo, wf.GetID(), runOpts)
+		if err != nil {
+			return nil, githubError(err, owner, repo)
+		}
+		for _, r := range rs.WorkflowRuns {
+			result, err := monitorRun(ctx, c, owner, repo, *wf, r, version, releases, releasedFiles, opt)
+			if err != nil {
+				return nil, err
+			}
+			if result != nil {
+				return result, nil
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		runOpts.Page = resp.NextPage
 	}
-	var wf github.Workflow
-	for _, w := range wfs.Workflows {
-		if w.GetName() == opt.Workflow {
-			wf = *w
+	return nil, nil
+}
+
+// findWorkflow returns the repo's workflow with the provided name.
+func findWorkflow(ctx context.Context, c *github.Client, owner, repo, name string) (*github.Workflow, error) {
+	wfOpts := &github.ListOptions{PerPage: 100}
+	for {
+		wfs, resp, err := c.Actions.ListWorkflows(ctx, owner, repo, wfOpts)
+		if err != nil {
+			return nil, githubError(err, owner, repo)
+		}
+		for _, w := range wfs.Workflows {
+			if w.GetName() == name {
+				return w, nil
+			}
+		}
+		if resp.NextPage == 0 {
+			break
 		}
+		wfOpts.Page = resp.NextPage
 	}
-	if wf.ID == nil {
-		return nil, errors.New("No workflow match")
+	return nil, fmt.Errorf("%w [repo=%s/%s, workflow=%s]", ErrNoWorkflow, owner, repo, name)
+}
+
+// monitorRun generates provenance for the release files produced by a single
+// workflow run. A nil result is returned if the run doesn't qualify.
+func monitorRun(ctx context.Context, c *github.Client, owner, repo string, wf github.Workflow, r *github.WorkflowRun, version string, releases []Release, releasedFiles map[string]time.Time, opt MonitorOptions) (*MonitorResult, error) {
+	var timely bool
+	for _, uploaded := range releasedFiles {
+		if r.GetCreatedAt().Time.Before(uploaded) && r.GetUpdatedAt().Time.After(uploaded) {
+			timely = true
+		}
 	}
-	rs, _, err := c.Actions.ListWorkflowRunsByID(ctx, owner, repo, *wf.ID, nil)
-	if err != nil {
-		log.Fatalln(err)
+	if !timely {
+		return nil, nil
 	}
-	for _, r := range rs.WorkflowRuns {
+	if opt.RequireSucceeded != nil {
 		js, _, err := c.Actions.ListWorkflowJobs(ctx, owner, repo, *r.ID, nil)
 		if err != nil {
-			log.Fatalln(err)
+			return nil, githubError(err, owner, repo)
 		}
-		var timely bool
-		for _, uploaded := range releasedFiles {
-			if r.GetCreatedAt().Time.Before(uploaded) && r.GetUpdatedAt().Time.After(uploaded) {
-				timely = true
-			}
-		}
-		if !timely {
-			continue
-		}
-		if opt.RequireSucceeded != nil {
-			var found, succeeded bool
-			for _, j := range js.Jobs {
-				if *j.Name == opt.RequireSucceeded.Job {
-					if opt.RequireSucceeded.Step == "" {
-						succeeded = *j.Conclusion == "success"
+		var found, succeeded bool
+		for _, j := range js.Jobs {
+			if *j.Name == opt.RequireSucceeded.Job {
+				if opt.RequireSucceeded.Step == "" {
+					succeeded = *j.Conclusion == "success"
+					found = true
+				}
+				for _, s := range j.Steps {
+					if *s.Name == opt.RequireSucceeded.Step {
+						succeeded = *s.Conclusion == "success"
 						found = true
 					}
-					for _, s := range j.Steps {
-						if *s.Name == opt.RequireSucceeded.Step {
-							succeeded = *s.Conclusion == "success"
-							found = true
-						}
-					}
 				}
 			}
-			if !found {
-				// TODO: Add a warning?
-				continue
-			}
-			if !succeeded {
-				continue
-			}
 		}
-		var subjects []in_toto.Subject
-		as, _, err := c.Actions.ListWorkflowRunArtifacts(ctx, owner, repo, *r.ID, nil)
-		var expired bool
+		if !found {
+			// TODO: Add a warning?
+			return nil, nil
+		}
+		if !succeeded {
+			return nil, nil
+		}
+	}
+	var subjects []in_toto.Subject
+	artifactOpts := &github.ListOptions{PerPage: 100}
+	for {
+		as, resp, err := c.Actions.ListWorkflowRunArtifacts(ctx, owner, repo, *r.ID, artifactOpts)
+		if err != nil {
+			return nil, githubError(err, owner, repo)
+		}
 		for _, a := range as.Artifacts {
 			var match *ArtifactSpec
-			for _, spec := range opt.Artifacts {
-				if spec.Name == a.GetName() {
-					match = &spec
+			for i := range opt.Artifacts {
+				if opt.Artifacts[i].Name == a.GetName() {
+					match = &opt.Artifacts[i]
 				}
 			}
 			if match == nil {
 				continue
 			}
 			if a.GetExpired() {
-				expired = true
-				break
-			}
-			u, err := url.Parse(a.GetArchiveDownloadURL())
-			if err != nil {
-				return nil, err
-			}
-			var h http.Client
-			resp, err := h.Do(&http.Request{
-				URL:    u,
-				Header: http.Header{"Authorization": []string{fmt.Sprintf("Bearer %s", *githubToken)}},
-			})
-			if err != nil {
-				return nil, err
-			}
-			if resp.StatusCode != 200 {
-				return nil, errors.New("Bad response code")
-			}
-			archive, err := io.ReadAll(resp.Body)
-			if err != nil {
-				return nil, err
+				log.Println("Skipping: Expired artifact")
+				return nil, nil
 			}
-			zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+			s, err := artifactSubjects(a, *match, owner, repo, r, releasedFiles)
 			if err != nil {
 				return nil, err
 			}
-			for _, f := range zr.File {
-				var matched bool
-				for _, path := range match.Patterns {
-					m, err := filepath.Match(path, f.Name)
-					if err != nil {
-						return nil, err
-					}
-					matched = matched || m
-				}
-				if !matched {
-					log.Printf("Excluding subject file [artifact=%s file=%s]", a.GetName(), f.Name)
-					continue
-				}
-				var timely bool
-				var realUpload time.Time
-				for fname, uploaded := range releasedFiles {
-					if fname == f.Name {
-						timely = r.GetCreatedAt().Time.Before(uploaded) && r.GetUpdatedAt().Time.After(uploaded)
-						realUpload = uploaded
-						break
-					}
-				}
-				if !timely {
-					log.Printf("Excluding subject file [artifact=%s file=%s ran=[from=%s to=%s] uploaded=%s]", a.GetName(), f.Name, r.GetCreatedAt(), r.GetUpdatedAt(), realUpload)
-					continue
-				}
-				h := sha256.New()
-				reader, err := f.Open()
-				if err != nil {
-					return nil, err
-				}
-				if _, err := io.Copy(h, reader); err != nil {
-					log.Fatal(err)
-				}
-				subjects = append(subjects, in_toto.Subject{
-					Name:   f.Name,
-					Digest: in_toto.DigestSet{"sha256": hex.EncodeToString(h.Sum(nil))},
-				})
-			}
+			subjects = append(subjects, s...)
 		}
-		if expired {
-			log.Println("Skipping: Expired artifact")
-			continue
+		if resp.NextPage == 0 {
+			break
 		}
-		if len(subjects) == 0 {
-			log.Println("Skipping: No artifacts to sign")
-			continue
-		}
-		sort.Slice(subjects, func(i, j int) bool { return subjects[i].Name < subjects[j].Name })
-		stmt := in_toto.ProvenanceStatement{
-			in_toto.StatementHeader{
-				Type:          "https://in-toto.io/Statement/v0.1",
-				PredicateType: "https://slsa.dev/provenance/v0.1",
-				Subject:       subjects,
+		artifactOpts.Page = resp.NextPage
+	}
+	if len(subjects) == 0 {
+		log.Println("Skipping: No artifacts to sign")
+		return nil, nil
+	}
+	sort.Slice(subjects, func(i, j int) bool { return subjects[i].Name < subjects[j].Name })
+	coverage, subjects := releaseCoverage(subjects, releases)
+	if len(subjects) == 0 {
+		log.Println("Skipping: No artifacts match the release")
+		return nil, nil
+	}
+	if !coverage.Complete {
+		log.Printf("Incomplete release coverage [run=%d missing=%v]", r.GetID(), coverage.Missing)
+	}
+	env := map[string]interface{}{"releaseCoverage": coverage}
+	if opt.IncludeSourceMetadata {
+		env["sourceMetadata"] = fetchSourceMetadata(ctx, c, owner, repo, r.GetHeadSHA(), r.GetHeadBranch())
+	}
+	stmt := in_toto.ProvenanceStatement{
+		in_toto.StatementHeader{
+			Type:          "https://in-toto.io/Statement/v0.1",
+			PredicateType: "https://slsa.dev/provenance/v0.1",
+			Subject:       subjects,
+		},
+		in_toto.ProvenancePredicate{
+			in_toto.ProvenanceBuilder{ID: "https://attestations.github.com/actions-workflow/unknown-runner@v1"},
+			in_toto.ProvenanceRecipe{
+				Type:              "https://slsa.dev/workflows/GitHubActionsWorkflow",
+				DefinedInMaterial: new(int),
+				EntryPoint:        wf.GetPath(),
+				Arguments:         []string{}, // TODO
+				Environment:       env,
 			},
-			in_toto.ProvenancePredicate{
-				in_toto.ProvenanceBuilder{ID: "https://attestations.github.com/actions-workflow/unknown-runner@v1"},
-				in_toto.ProvenanceRecipe{
-					Type:              "https://slsa.dev/workflows/GitHubActionsWorkflow",
-					DefinedInMaterial: new(int),
-					EntryPoint:        wf.GetPath(),
-					Arguments:         []string{}, // TODO
-					Environment:       []string{},
-				},
-				&in_toto.ProvenanceMetadata{
-					BuildStartedOn:  &r.CreatedAt.Time,
-					BuildFinishedOn: &r.UpdatedAt.Time,
-					Completeness:    in_toto.ProvenanceComplete{Arguments: false, Environment: false, Materials: false},
-					Reproducible:    false,
-				},
-				[]in_toto.ProvenanceMaterial{
-					{
-						URI:    fmt.Sprintf("git+%s@%s", r.GetHeadRepository().GetHTMLURL(), r.GetHeadBranch()),
-						Digest: in_toto.DigestSet{"sha1": r.GetHeadSHA()},
-					},
+			&in_toto.ProvenanceMetadata{
+				BuildStartedOn:  &r.CreatedAt.Time,
+				BuildFinishedOn: &r.UpdatedAt.Time,
+				Completeness:    in_toto.ProvenanceComplete{Arguments: false, Environment: false, Materials: false},
+				Reproducible:    false,
+			},
+			[]in_toto.ProvenanceMaterial{
+				{
+					URI:    fmt.Sprintf("git+%s@%s", r.GetHeadRepository().GetHTMLURL(), r.GetHeadBranch()),
+					Digest: in_toto.DigestSet{"sha1": r.GetHeadSHA()},
 				},
 			},
+		},
+	}
+	return &MonitorResult{
+		Statement: stmt,
+		Version:   version,
+		Workflow:  wf.GetPath(),
+		RunID:     r.GetID(),
+		Commit:    r.GetHeadSHA(),
+		Branch:    r.GetHeadBranch(),
+		Duration:  r.GetUpdatedAt().Time.Sub(r.GetCreatedAt().Time),
+		Coverage:  coverage,
+	}, nil
+}
+
+// ReleaseCoverage records which of a version's published files are attested
+// to by a statement's subjects.
+type ReleaseCoverage struct {
+	Complete bool     `json:"complete"`
+	Covered  []string `json:"covered"`
+	Missing  []string `json:"missing"`
+}
+
+// releaseCoverage correlates subjects with the published release files and
+// returns the subjects that match a release file by both name and digest.
+// Files are only covered by such a subject; others are dropped so that they
+// aren't attested to.
+func releaseCoverage(subjects []in_toto.Subject, releases []Release) (ReleaseCoverage, []in_toto.Subject) {
+	digests := make(map[string]string, len(releases))
+	for _, r := range releases {
+		digests[r.Filename] = r.Digests.SHA256
+	}
+	var matched []in_toto.Subject
+	covered := make(map[string]bool)
+	for _, s := range subjects {
+		digest, ok := digests[s.Name]
+		switch {
+		case !ok:
+			log.Printf("Subject is not a release file [file=%s]", s.Name)
+		case s.Digest["sha256"] != digest:
+			log.Printf("Subject digest differs from release [file=%s subject=%s release=%s]", s.Name, s.Digest["sha256"], digest)
+		default:
+			matched = append(matched, s)
+			covered[s.Name] = true
 		}
-		return &stmt, nil
 	}
-	return nil, nil
+	coverage := ReleaseCoverage{Covered: []string{}, Missing: []string{}}
+	for _, r := range releases {
+		if covered[r.Filename] {
+			coverage.Covered = append(coverage.Covered, r.Filename)
+		} else {
+			coverage.Missing = append(coverage.Missing, r.Filename)
+		}
+	}
+	sort.Strings(coverage.Covered)
+	sort.Strings(coverage.Missing)
+	coverage.Complete = len(coverage.Missing) == 0
+	return coverage, matched
+}
+
+// artifactSubjects downloads a workflow run artifact and returns a subject for
+// each of its files matching the spec that was released during the run.
+func artifactSubjects(a *github.Artifact, spec ArtifactSpec, owner, repo string, r *github.WorkflowRun, releasedFiles map[string]time.Time) ([]in_toto.Subject, error) {
+	u, err := url.Parse(a.GetArchiveDownloadURL())
+	if err != nil {
+		return nil, err
+	}
+	var h http.Client
+	resp, err := h.Do(&http.Request{
+		URL:    u,
+		Header: http.Header{"Authorization": []string{fmt.Sprintf("Bearer %s", *githubToken)}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusForbidden:
+		return nil, &PermissionError{Repo: owner + "/" + repo, Err: fmt.Errorf("Artifact download denied [artifact=%s]", a.GetName())}
+	case resp.StatusCode != 200:
+		return nil, errors.New("Bad response code")
+	}
+	archive, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var subjects []in_toto.Subject
+	err = walkArchive(archive, func(name string, reader io.Reader) error {
+		var matched bool
+		for _, path := range spec.Patterns {
+			m, err := filepath.Match(path, name)
+			if err != nil {
+				return err
+			}
+			matched = matched || m
+		}
+		if !matched {
+			log.Printf("Excluding subject file [artifact=%s file=%s]", a.GetName(), name)
+			return nil
+		}
+		var timely bool
+		var realUpload time.Time
+		for fname, uploaded := range releasedFiles {
+			if fname == name {
+				timely = r.GetCreatedAt().Time.Before(uploaded) && r.GetUpdatedAt().Time.After(uploaded)
+				realUpload = uploaded
+				break
+			}
+		}
+		if !timely {
+			log.Printf("Excluding subject file [artifact=%s file=%s ran=[from=%s to=%s] uploaded=%s]", a.GetName(), name, r.GetCreatedAt(), r.GetUpdatedAt(), realUpload)
+			return nil
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, reader); err != nil {
+			return err
+		}
+		subjects = append(subjects, in_toto.Subject{
+			Name:   name,
+			Digest: in_toto.DigestSet{"sha256": hex.EncodeToString(h.Sum(nil))},
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return subjects, nil
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v40/github"
+	"github.com/in-toto/in-toto-golang/in_toto"
+)
+
+func zipArchive(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestMonitorBuildPaginates(t *testing.T) {
+	const wheel, content = "pkg-1.0-py3-none-any.whl", "wheel contents"
+	uploaded := time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC)
+	digest := sha256.Sum256([]byte(content))
+	releases := []Release{{
+		Digests:    Digests{SHA256: hex.EncodeToString(digest[:])},
+		Filename:   wheel,
+		UploadTime: uploaded,
+	}}
+	run := func(id int64, start time.Time) map[string]interface{} {
+		return map[string]interface{}{
+			"id":              id,
+			"head_sha":        fmt.Sprintf("%040d", id),
+			"head_branch":     "main",
+			"created_at":      start.Format(time.RFC3339),
+			"updated_at":      start.Add(time.Hour).Format(time.RFC3339),
+			"head_repository": map[string]interface{}{"html_url": "https://github.com/o/r"},
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/o/r/actions/workflows", func(rw http.ResponseWriter, req *http.Request) {
+		page := servePage(rw, req, 3)
+		wfs := []map[string]interface{}{{"id": page*10 + 1, "name": fmt.Sprintf("ci-%d", page)}}
+		if page == 3 {
+			wfs = append(wfs, map[string]interface{}{"id": 7, "name": "release", "path": ".github/workflows/release.yml"})
+		}
+		json.NewEncoder(rw).Encode(map[string]interface{}{"total_count": 4, "workflows": wfs})
+	})
+	mux.HandleFunc("/repos/o/r/actions/workflows/7/runs", func(rw http.ResponseWriter, req *http.Request) {
+		page := servePage(rw, req, 4)
+		var runs []map[string]interface{}
+		switch page {
+		case 1, 2:
+			// Runs that finished before the upload.
+			runs = append(runs, run(int64(page*10+1), uploaded.Add(-time.Duration(page)*24*time.Hour)))
+			runs = append(runs, run(int64(page*10+2), uploaded.Add(-time.Duration(page)*48*time.Hour)))
+		case 3:
+			runs = append(runs, run(31, uploaded.Add(-72*time.Hour)))
+			runs = append(runs, run(32, uploaded.Add(-30*time.Minute)))
+		default:
+			t.Errorf("Requested runs page %d after a match was found", page)
+		}
+		json.NewEncoder(rw).Encode(map[string]interface{}{"total_count": 8, "workflow_runs": runs})
+	})
+	var srvURL string
+	mux.HandleFunc("/repos/o/r/actions/runs/32/artifacts", func(rw http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(rw).Encode(map[string]interface{}{
+			"total_count": 1,
+			"artifacts": []map[string]interface{}{{
+				"id":                   1,
+				"name":                 "dist",
+				"archive_download_url": srvURL + "/download/dist.zip",
+			}},
+		})
+	})
+	mux.HandleFunc("/download/dist.zip", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(zipArchive(t, map[string]string{wheel: content, "other.txt": "excluded"}))
+	})
+	c, srv := testGitHubClient(t, mux)
+	srvURL = srv.URL
+	opt := MonitorOptions{GitHubActions: GitHubActions{
+		Workflow:  "release",
+		Artifacts: []ArtifactSpec{{Name: "dist", Patterns: []string{"*.whl"}}},
+	}}
+	result, err := monitorBuild(context.Background(), c, "o", "r", "1.0", releases, opt)
+	if err != nil {
+		t.Fatalf("monitorBuild() = %v", err)
+	}
+	if result == nil {
+		t.Fatal("monitorBuild() found no run")
+	}
+	if result.RunID != 32 {
+		t.Errorf("RunID = %d, want 32", result.RunID)
+	}
+	if result.Workflow != ".github/workflows/release.yml" {
+		t.Errorf("Workflow = %q, want %q", result.Workflow, ".github/workflows/release.yml")
+	}
+	if !result.Coverage.Complete {
+		t.Errorf("Coverage = %+v, want complete", result.Coverage)
+	}
+	if subjects := result.Statement.Subject; len(subjects) != 1 || subjects[0].Name != wheel {
+		t.Errorf("Subject = %+v, want only %s", subjects, wheel)
+	}
+}
+
+func TestReleaseCoverage(t *testing.T) {
+	const (
+		wheel = "pkg-1.0-py3-none-any.whl"
+		sdist = "pkg-1.0.tar.gz"
+	)
+	wheelDigest, sdistDigest := strings.Repeat("a", 64), strings.Repeat("b", 64)
+	releases := []Release{
+		{Filename: wheel, Digests: Digests{SHA256: wheelDigest}},
+		{Filename: sdist, Digests: Digests{SHA256: sdistDigest}},
+	}
+	subject := func(name, digest string) in_toto.Subject {
+		return in_toto.Subject{Name: name, Digest: in_toto.DigestSet{"sha256": digest}}
+	}
+	for _, tc := range []struct {
+		name     string
+		subjects []in_toto.Subject
+		want     ReleaseCoverage
+		matched  []in_toto.Subject
+	}{
+		{
+			name:     "complete",
+			subjects: []in_toto.Subject{subject(sdist, sdistDigest), subject(wheel, wheelDigest)},
+			want:     ReleaseCoverage{Complete: true, Covered: []string{wheel, sdist}, Missing: []string{}},
+			matched:  []in_toto.Subject{subject(sdist, sdistDigest), subject(wheel, wheelDigest)},
+		},
+		{
+			name:     "missing file",
+			subjects: []in_toto.Subject{subject(wheel, wheelDigest)},
+			want:     ReleaseCoverage{Covered: []string{wheel}, Missing: []string{sdist}},
+			matched:  []in_toto.Subject{subject(wheel, wheelDigest)},
+		},
+		{
+			name:     "digest mismatch",
+			subjects: []in_toto.Subject{subject(sdist, sdistDigest), subject(wheel, strings.Repeat("0", 64))},
+			want:     ReleaseCoverage{Covered: []string{sdist}, Missing: []string{wheel}},
+			matched:  []in_toto.Subject{subject(sdist, sdistDigest)},
+		},
+		{
+			name:     "unreleased file",
+			subjects: []in_toto.Subject{subject("pkg-1.0-cp39-cp39-linux_x86_64.whl", wheelDigest), subject(wheel, wheelDigest)},
+			want:     ReleaseCoverage{Covered: []string{wheel}, Missing: []string{sdist}},
+			matched:  []in_toto.Subject{subject(wheel, wheelDigest)},
+		},
+		{
+			name:     "no matches",
+			subjects: []in_toto.Subject{subject(wheel, sdistDigest)},
+			want:     ReleaseCoverage{Covered: []string{}, Missing: []string{wheel, sdist}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			coverage, matched := releaseCoverage(tc.subjects, releases)
+			if !reflect.DeepEqual(coverage, tc.want) {
+				t.Errorf("releaseCoverage() coverage = %+v, want %+v", coverage, tc.want)
+			}
+			if !reflect.DeepEqual(matched, tc.matched) {
+				t.Errorf("releaseCoverage() subjects = %+v, want %+v", matched, tc.matched)
+			}
+		})
+	}
+}
+
+func TestFindWorkflowMissing(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/o/r/actions/workflows", func(rw http.ResponseWriter, req *http.Request) {
+		page := servePage(rw, req, 2)
+		json.NewEncoder(rw).Encode(&github.Workflows{
+			TotalCount: github.Int(2),
+			Workflows:  []*github.Workflow{{ID: github.Int64(int64(page)), Name: github.String(fmt.Sprintf("ci-%d", page))}},
+		})
+	})
+	c, _ := testGitHubClient(t, mux)
+	if _, err := findWorkflow(context.Background(), c, "o", "r", "release"); !errors.Is(err, ErrNoWorkflow) {
+		t.Errorf("findWorkflow() = %v, want %v", err, ErrNoWorkflow)
+	}
+}
@@ -23,12 +23,26 @@ type Policy struct {
 	BuildMonitor     *BuildMonitor     `yaml:"build_monitor"`
 	Rebuilder        *Rebuilder        `yaml:"rebuilder"`
 	ProvenanceUpload *ProvenanceUpload `yaml:"provenance_upload"`
-	Digest           string
-	Scope            string
-	Package          string
+	// IncludeSourceMetadata adds the branch protection and review status of
+	// the source commit to generated provenance. This costs extra API calls.
+	IncludeSourceMetadata bool `yaml:"include_source_metadata"`
+	Digest                string
+	Scope                 string
+	Package               string
 }
 type Rebuilder struct {
-	PackageRoot string `yaml:"package_root"`
+	PackageRoot   string          `yaml:"package_root"`
+	PythonVersion string          `yaml:"python_version"`
+	Normalize     []NormalizeStep `yaml:"normalize"`
+}
+
+// NormalizeStep is a shell command run after the default metadata transfer to
+// remove irrelevant differences between the original and rebuilt artifacts.
+// Their paths are available to the command as $ORIGINAL and $REBUILT.
+type NormalizeStep struct {
+	// Image defaults to that used for the build.
+	Image   string `yaml:"image"`
+	Command string `yaml:"command"`
 }
 type ProvenanceUpload struct {
 	AuthorizedBuilders []string `yaml:"authorized_builders"`
@@ -54,7 +68,7 @@ func fetchPolicy(c *github.Client, scope, pkg, ref string) (*Policy, error) {
 	file, _, _, err := c.Repositories.GetContents(
 		context.Background(), *policyRepoOwner, *policyRepoName, filepath.Join(*policyRepoDir, scope, pkg, "policy.yaml"), &github.RepositoryContentGetOptions{Ref: ref})
 	if err != nil {
-		return nil, err
+		return nil, githubError(err, *policyRepoOwner, *policyRepoName)
 	}
 	content, err := file.GetContent()
 	if err != nil {
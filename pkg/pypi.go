@@ -6,9 +6,17 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"sort"
+	"strings"
 	"time"
+
+	"github.com/in-toto/in-toto-golang/in_toto"
 )
 
+// pypiURL is the base URL of the PyPI JSON API.
+var pypiURL = "https://pypi.org/pypi"
+
 type PyPiProject struct {
 	Info     `json:"info"`
 	Releases map[string][]Release `json:"releases"`
@@ -25,8 +33,52 @@ type Release struct {
 	UploadTime    time.Time `json:"upload_time_iso_8601"`
 }
 type Digests struct {
-	MD5    string `json:"md5"`
-	SHA256 string `json:"sha256"`
+	MD5        string `json:"md5"`
+	SHA256     string `json:"sha256"`
+	Blake2b256 string `json:"blake2b_256"`
+}
+
+// DigestSet returns the available digests keyed by in-toto algorithm name.
+func (d Digests) DigestSet() in_toto.DigestSet {
+	ds := in_toto.DigestSet{}
+	for alg, digest := range map[string]string{"md5": d.MD5, "sha256": d.SHA256, "blake2b_256": d.Blake2b256} {
+		if digest != "" {
+			ds[alg] = digest
+		}
+	}
+	return ds
+}
+
+// validateSubjects checks that there is at least one subject and that each
+// names a release file whose digest matches for at least one algorithm present
+// in both digest sets.
+func validateSubjects(subjects []in_toto.Subject, releases []Release) error {
+	if len(subjects) == 0 {
+		return ErrNoSubjects
+	}
+	byName := make(map[string]Release, len(releases))
+	for _, r := range releases {
+		byName[r.Filename] = r
+	}
+	for _, s := range subjects {
+		r, ok := byName[s.Name]
+		if !ok {
+			return fmt.Errorf("%w [file=%s]", ErrUnknownSubject, s.Name)
+		}
+		var match bool
+		var shared []string
+		for alg, digest := range r.Digests.DigestSet() {
+			if d, ok := s.Digest[alg]; ok {
+				shared = append(shared, alg)
+				match = match || strings.EqualFold(d, digest)
+			}
+		}
+		if !match {
+			sort.Strings(shared)
+			return fmt.Errorf("%w [file=%s, shared=%v]", ErrSubjectMismatch, s.Name, shared)
+		}
+	}
+	return nil
 }
 
 func get(url string) []byte {
@@ -42,10 +94,44 @@ func get(url string) []byte {
 }
 
 func pypiMetadata(pkg string) PyPiProject {
-	bytes := get(fmt.Sprintf("https://pypi.org/pypi/%s/json", pkg))
+	bytes := get(fmt.Sprintf("%s/%s/json", pypiURL, pkg))
 	project := PyPiProject{}
 	if err := json.Unmarshal(bytes, &project); err != nil {
 		log.Fatal(err)
 	}
 	return project
 }
+
+// fetchProject returns the PyPI metadata of a package.
+func fetchProject(pkg string) (PyPiProject, error) {
+	resp, err := http.Get(fmt.Sprintf("%s/%s/json", pypiURL, url.PathEscape(pkg)))
+	if err != nil {
+		return PyPiProject{}, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return PyPiProject{}, fmt.Errorf("%w [pkg=%s]", ErrUnknownPackage, pkg)
+	case resp.StatusCode != http.StatusOK:
+		return PyPiProject{}, fmt.Errorf("Bad response code from PyPI [pkg=%s, code=%d]", pkg, resp.StatusCode)
+	}
+	project := PyPiProject{}
+	if err := json.NewDecoder(resp.Body).Decode(&project); err != nil {
+		return PyPiProject{}, fmt.Errorf("Malformed PyPI response [pkg=%s]: %v", pkg, err)
+	}
+	return project, nil
+}
+
+// latestVersion returns the latest version of a package reported by PyPI.
+// NOTE: PyPI reports the latest stable release, ignoring pre-releases unless
+// no stable release exists.
+func latestVersion(pkg string) (string, error) {
+	project, err := fetchProject(pkg)
+	if err != nil {
+		return "", err
+	}
+	if project.LatestVersion == "" {
+		return "", fmt.Errorf("%w [pkg=%s]", ErrUnknownPackage, pkg)
+	}
+	return project.LatestVersion, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/in-toto/in-toto-golang/in_toto"
+)
+
+func TestValidateSubjects(t *testing.T) {
+	const (
+		wheel  = "idna-3.3-py3-none-any.whl"
+		md5    = "5856306eac5f25db8249e37a4c6ee3e7"
+		sha256 = "84d9dd047ffa80596e0f246e2eab0b391788b0503584e8945f2368256d2735ff"
+		blake2 = "7d4e4a3ec4bd5e16d7fb6bd6a1ab4b1b6d7b3a8a25e0ee8dfeb8a6a0f4f5e43e"
+	)
+	releases := []Release{
+		{Filename: wheel, Digests: Digests{MD5: md5, SHA256: sha256, Blake2b256: blake2}},
+		{Filename: "idna-3.3.tar.gz", Digests: Digests{SHA256: strings.Repeat("1", 64)}},
+	}
+	subject := func(digests in_toto.DigestSet) []in_toto.Subject {
+		return []in_toto.Subject{{Name: wheel, Digest: digests}}
+	}
+	for _, tc := range []struct {
+		name     string
+		subjects []in_toto.Subject
+		err      error
+	}{
+		{"sha256", subject(in_toto.DigestSet{"sha256": sha256}), nil},
+		{"md5", subject(in_toto.DigestSet{"md5": md5}), nil},
+		{"blake2b_256", subject(in_toto.DigestSet{"blake2b_256": blake2}), nil},
+		{"uppercase digest", subject(in_toto.DigestSet{"sha256": strings.ToUpper(sha256)}), nil},
+		{"any shared algorithm matches", subject(in_toto.DigestSet{"sha256": strings.Repeat("0", 64), "md5": md5}), nil},
+		{"unshared algorithms ignored", subject(in_toto.DigestSet{"sha512": strings.Repeat("0", 128), "sha256": sha256}), nil},
+		{
+			name: "multiple files",
+			subjects: []in_toto.Subject{
+				{Name: wheel, Digest: in_toto.DigestSet{"sha256": sha256}},
+				{Name: "idna-3.3.tar.gz", Digest: in_toto.DigestSet{"sha256": strings.Repeat("1", 64)}},
+			},
+		},
+		{"no shared algorithm", subject(in_toto.DigestSet{"sha512": strings.Repeat("0", 128)}), ErrSubjectMismatch},
+		{"no digests", subject(in_toto.DigestSet{}), ErrSubjectMismatch},
+		{"shared algorithm mismatch", subject(in_toto.DigestSet{"sha256": strings.Repeat("0", 64), "md5": strings.Repeat("0", 32)}), ErrSubjectMismatch},
+		{
+			name: "algorithm missing from release",
+			subjects: []in_toto.Subject{
+				{Name: "idna-3.3.tar.gz", Digest: in_toto.DigestSet{"md5": md5}},
+			},
+			err: ErrSubjectMismatch,
+		},
+		{
+			name:     "unknown file",
+			subjects: []in_toto.Subject{{Name: "idna-3.4-py3-none-any.whl", Digest: in_toto.DigestSet{"sha256": sha256}}},
+			err:      ErrUnknownSubject,
+		},
+		{"no subjects", nil, ErrNoSubjects},
+		{"empty subjects", []in_toto.Subject{}, ErrNoSubjects},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateSubjects(tc.subjects, releases)
+			switch {
+			case tc.err == nil && err != nil:
+				t.Errorf("validateSubjects() = %v, want nil", err)
+			case tc.err != nil && !errors.Is(err, tc.err):
+				t.Errorf("validateSubjects() = %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestLatestVersion(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pypi/idna/json", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(`{"info": {"version": "3.3"}, "releases": {"3.2": [], "3.3": []}}`))
+	})
+	mux.HandleFunc("/pypi/missing/json", func(rw http.ResponseWriter, req *http.Request) {
+		http.Error(rw, `{"message": "Not Found"}`, 404)
+	})
+	mux.HandleFunc("/pypi/unavailable/json", func(rw http.ResponseWriter, req *http.Request) {
+		http.Error(rw, "Service Unavailable", 503)
+	})
+	testPyPI(t, mux)
+	if v, err := latestVersion("idna"); err != nil || v != "3.3" {
+		t.Errorf("latestVersion(idna) = (%q, %v), want 3.3", v, err)
+	}
+	if _, err := latestVersion("missing"); !errors.Is(err, ErrUnknownPackage) {
+		t.Errorf("latestVersion(missing) = %v, want %v", err, ErrUnknownPackage)
+	}
+	if _, err := latestVersion("unavailable"); err == nil || errors.Is(err, ErrUnknownPackage) {
+		t.Errorf("latestVersion(unavailable) = %v, want non-404 error", err)
+	}
+	// Names are escaped rather than interpreted as paths.
+	if _, err := latestVersion("../idna"); !errors.Is(err, ErrUnknownPackage) {
+		t.Errorf("latestVersion(../idna) = %v, want %v", err, ErrUnknownPackage)
+	}
+}
+
+func TestFetchProject(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pypi/idna/json", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(`{"info": {"version": "3.3"}, "releases": {"3.3": [{"filename": "idna-3.3.tar.gz"}]}}`))
+	})
+	mux.HandleFunc("/pypi/missing/json", func(rw http.ResponseWriter, req *http.Request) {
+		http.Error(rw, `{"message": "Not Found"}`, 404)
+	})
+	mux.HandleFunc("/pypi/unavailable/json", func(rw http.ResponseWriter, req *http.Request) {
+		http.Error(rw, "Service Unavailable", 503)
+	})
+	mux.HandleFunc("/pypi/malformed/json", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(`<html>`))
+	})
+	testPyPI(t, mux)
+	proj, err := fetchProject("idna")
+	if err != nil {
+		t.Fatalf("fetchProject(idna) = %v", err)
+	}
+	if files := proj.Releases["3.3"]; len(files) != 1 || files[0].Filename != "idna-3.3.tar.gz" {
+		t.Errorf("fetchProject(idna) releases = %+v", proj.Releases)
+	}
+	for pkg, code := range map[string]int{"missing": 404, "unavailable": 500, "malformed": 500} {
+		_, err := fetchProject(pkg)
+		if err == nil {
+			t.Errorf("fetchProject(%s) succeeded, want error", pkg)
+			continue
+		}
+		if got, _ := errorResponse(err, "fallback"); got != code {
+			t.Errorf("errorResponse(fetchProject(%s)) code = %d, want %d", pkg, got, code)
+		}
+	}
+}
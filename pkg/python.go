@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Python interpreter versions the rebuilder is able to install.
+// Each corresponds to an official `python:<version>-alpine` image.
+var supportedPythonVersions = []string{"3.8", "3.9", "3.10", "3.11", "3.12"}
+
+// Interpreter used when the artifact gives no indication of the one used.
+const defaultPythonVersion = "3.9"
+
+func isSupportedPython(version string) bool {
+	for _, v := range supportedPythonVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// pythonTagVersion returns the interpreter version of a wheel python tag.
+// Tags without a minor version (e.g. "py3") yield the empty string. For
+// compressed tag sets (e.g. "py38.py39"), the newest supported version is
+// preferred.
+// See https://www.python.org/dev/peps/pep-0425/#python-tag
+func pythonTagVersion(tag string) string {
+	tagRe := regexp.MustCompile(`^(?:py|cp)3(\d+)$`)
+	var version string
+	for _, t := range strings.Split(tag, ".") {
+		segs := tagRe.FindStringSubmatch(t)
+		if len(segs) == 0 {
+			continue
+		}
+		v := "3." + segs[1]
+		switch {
+		case version == "":
+			version = v
+		case isSupportedPython(v) && (!isSupportedPython(version) || comparePython(v, version) > 0):
+			version = v
+		}
+	}
+	return version
+}
+
+// pythonHints holds the data used to infer the build interpreter of a wheel.
+type pythonHints struct {
+	// Override is the version specified by policy, if any.
+	Override  string
+	Filename  string
+	Files     []string
+	Metadata  []byte
+	WheelInfo []byte
+}
+
+// pythonStrategies infer the build interpreter of a wheel, in order of
+// precedence. Each returns the empty string when it does not apply.
+// A policy override always wins. Files generated by the build itself record
+// the interpreter that ran it so they take precedence over the wheel tag,
+// which only declares the versions the project supports. Requires-Python is
+// merely a constraint and so is consulted last.
+var pythonStrategies = []struct {
+	Name   string
+	Detect func(h pythonHints) string
+}{
+	{"policy", func(h pythonHints) string { return h.Override }},
+	{"nspkg", func(h pythonHints) string { return nspkgPythonVersion(h.Files) }},
+	{"compiled_files", func(h pythonHints) string { return compiledPythonVersion(h.Files) }},
+	{"wheel_tag", func(h pythonHints) string { return wheelPythonVersion(h.Filename, h.WheelInfo) }},
+	{"requires_python", func(h pythonHints) string { return requiresPythonVersion(h.Metadata) }},
+}
+
+// detectPythonVersion returns the interpreter version with which to rebuild a
+// wheel along with the name of the strategy that selected it.
+func detectPythonVersion(h pythonHints) (version, strategy string) {
+	for _, s := range pythonStrategies {
+		if v := s.Detect(h); v != "" {
+			return v, s.Name
+		}
+	}
+	return defaultPythonVersion, "default"
+}
+
+// nspkgPythonVersion returns the interpreter version embedded in the name of
+// a namespace package's "-nspkg.pth" file, if one is present.
+func nspkgPythonVersion(files []string) string {
+	// Names of the form: "pkg_name-version-py3.10-nspkg.pth"
+	pthRe := regexp.MustCompile(`[^-]+-[^-]+-py(\d+\.\d+)-nspkg.pth$`)
+	for _, f := range files {
+		segs := pthRe.FindStringSubmatch(f)
+		if len(segs) != 0 {
+			return segs[1]
+		}
+	}
+	return ""
+}
+
+// compiledPythonVersion returns the interpreter version embedded in the names
+// of bytecode or extension modules shipped in a wheel, if any are present.
+func compiledPythonVersion(files []string) string {
+	// Names of the form: "__pycache__/mod.cpython-310.pyc",
+	// "mod.cpython-310-x86_64-linux-gnu.so" or "mod.cp310-win_amd64.pyd"
+	compiledRe := regexp.MustCompile(`\.(?:cpython-|cp)3(\d+)(?:-[\w-]+)?\.(?:pyc|so|pyd)$`)
+	for _, f := range files {
+		segs := compiledRe.FindStringSubmatch(f)
+		if len(segs) != 0 {
+			return "3." + segs[1]
+		}
+	}
+	return ""
+}
+
+// wheelPythonVersion returns the interpreter version indicated by the python
+// tag of a wheel's filename or, failing that, by the "Tag" entries of its
+// WHEEL file.
+func wheelPythonVersion(filename string, wheelInfo []byte) string {
+	// Names of the form: "name-version(-build)?-pytag-abitag-platformtag.whl"
+	segs := strings.Split(strings.TrimSuffix(filename, ".whl"), "-")
+	if len(segs) >= 5 {
+		if v := pythonTagVersion(segs[len(segs)-3]); v != "" {
+			return v
+		}
+	}
+	re := regexp.MustCompile(`(?m)^Tag: ([^-\s]+)-`)
+	for _, m := range re.FindAllSubmatch(wheelInfo, -1) {
+		if v := pythonTagVersion(string(m[1])); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// requiresPythonVersion returns the interpreter version to use according to
+// the "Requires-Python" field of a wheel's METADATA. The default version is
+// preferred when it is permitted, otherwise the oldest permitted supported
+// version is used. If no supported version is permitted, the lower bound of
+// the constraint is returned.
+func requiresPythonVersion(metadata []byte) string {
+	re := regexp.MustCompile(`(?m)^Requires-Python:\s*(.*?)\s*$`)
+	segs := re.FindSubmatch(metadata)
+	if len(segs) == 0 || len(segs[1]) == 0 {
+		return ""
+	}
+	spec := string(segs[1])
+	if pythonSatisfies(defaultPythonVersion, spec) {
+		return defaultPythonVersion
+	}
+	for _, v := range supportedPythonVersions {
+		if pythonSatisfies(v, spec) {
+			return v
+		}
+	}
+	clauseRe := regexp.MustCompile(`(?:>=|~=|==)\s*(3\.\d+)`)
+	if m := clauseRe.FindStringSubmatch(spec); len(m) != 0 {
+		return m[1]
+	}
+	return defaultPythonVersion
+}
+
+// pythonSatisfies reports whether the interpreter version satisfies each
+// clause of a version specifier (e.g. ">=3.6, !=3.7.*, <4").
+// Clauses are compared using only their major and minor components. As the
+// rebuilder installs the newest patch release of an interpreter, clauses with
+// a patch component on the same minor version are evaluated against it, and
+// "==" and "!=" clauses on a single patch release are ignored.
+// See https://www.python.org/dev/peps/pep-0440/#version-specifiers
+func pythonSatisfies(version, spec string) bool {
+	clauseRe := regexp.MustCompile(`^(~=|==|!=|<=|>=|<|>)\s*(\d+(?:\.\d+)?)(\.\d+)*(\.\*)?`)
+	for _, clause := range strings.Split(spec, ",") {
+		segs := clauseRe.FindStringSubmatch(strings.TrimSpace(clause))
+		if len(segs) == 0 {
+			continue
+		}
+		v := version
+		if segs[4] != "" && !strings.Contains(segs[2], ".") {
+			// Wildcard on the major version only (e.g. "==3.*").
+			v = strings.SplitN(version, ".", 2)[0]
+		}
+		c := comparePython(v, segs[2])
+		var ok bool
+		switch {
+		case c == 0 && segs[3] != "" && segs[4] == "":
+			// Patch releases (e.g. "!=3.9.1") can't exclude the minor version.
+			switch segs[1] {
+			case "<", "<=":
+				ok = false
+			default:
+				ok = true
+			}
+		case segs[1] == "~=" && segs[3] != "":
+			// "~=3.9.1" is equivalent to ">=3.9.1, ==3.9.*".
+			ok = c == 0
+		case segs[1] == "~=", segs[1] == ">=":
+			ok = c >= 0
+		case segs[1] == "==":
+			ok = c == 0
+		case segs[1] == "!=":
+			ok = c != 0
+		case segs[1] == "<=":
+			ok = c <= 0
+		case segs[1] == "<":
+			ok = c < 0
+		case segs[1] == ">":
+			ok = c > 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// comparePython compares two "major[.minor]" versions, returning -1, 0 or 1.
+// A missing minor component is treated as zero.
+func comparePython(a, b string) int {
+	pa, pb := strings.SplitN(a, ".", 3), strings.SplitN(b, ".", 3)
+	for i := 0; i < 2; i++ {
+		var x, y int
+		if i < len(pa) {
+			x, _ = strconv.Atoi(pa[i])
+		}
+		if i < len(pb) {
+			y, _ = strconv.Atoi(pb[i])
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+// setuptoolsVersion returns the setuptools requirement for a rebuild.
+// Releases prior to 66.1 depend on distutils and pkgutil.ImpImporter, both of
+// which were removed in python 3.12.
+func setuptoolsVersion(pythonVersion string, metadata []byte) string {
+	switch {
+	case comparePython(pythonVersion, "3.12") >= 0:
+		return "==68.2.2"
+	case bytes.Contains(metadata, []byte("License-File")):
+		return "==58.3.0"
+	default:
+		return "==56.2.0"
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import "testing"
+
+func TestPythonTagVersion(t *testing.T) {
+	for _, tc := range []struct {
+		tag  string
+		want string
+	}{
+		{"py3", ""},
+		{"py2.py3", ""},
+		{"cp27", ""},
+		{"py38", "3.8"},
+		{"cp39", "3.9"},
+		{"py310", "3.10"},
+		{"cp311", "3.11"},
+		{"cp312", "3.12"},
+		{"cp313", "3.13"},
+		{"py38.py39", "3.9"},
+		{"py311.py313", "3.11"},
+	} {
+		if got := pythonTagVersion(tc.tag); got != tc.want {
+			t.Errorf("pythonTagVersion(%q) = %q, want %q", tc.tag, got, tc.want)
+		}
+	}
+}
+
+func TestWheelPythonVersion(t *testing.T) {
+	for _, tc := range []struct {
+		filename  string
+		wheelInfo string
+		want      string
+	}{
+		{"idna-3.3-py3-none-any.whl", "Tag: py3-none-any\n", ""},
+		{"pkg-1.0-py38-none-any.whl", "", "3.8"},
+		{"pkg-1.0-cp39-cp39-manylinux_2_17_x86_64.whl", "", "3.9"},
+		{"pkg-1.0-1-py310-none-any.whl", "", "3.10"},
+		{"pkg-1.0-cp311-cp311-musllinux_1_1_x86_64.whl", "", "3.11"},
+		{"pkg-1.0-py312-none-any.whl", "Tag: py38-none-any\n", "3.12"},
+		{"pkg-1.0-py3-none-any.whl", "Wheel-Version: 1.0\nTag: py311-none-any\n", "3.11"},
+		{"pkg-1.0-py3-none-any.whl", "Tag: py3-none-any\nTag: cp310-none-any\n", "3.10"},
+		{"malformed.whl", "", ""},
+	} {
+		if got := wheelPythonVersion(tc.filename, []byte(tc.wheelInfo)); got != tc.want {
+			t.Errorf("wheelPythonVersion(%q, %q) = %q, want %q", tc.filename, tc.wheelInfo, got, tc.want)
+		}
+	}
+}
+
+func TestRequiresPythonVersion(t *testing.T) {
+	for _, tc := range []struct {
+		metadata string
+		want     string
+	}{
+		{"Name: pkg\nVersion: 1.0\n", ""},
+		{"Requires-Python: \n", ""},
+		{"Requires-Python: >=3.6\n", defaultPythonVersion},
+		{"Requires-Python: >=3.10\n", "3.10"},
+		{"Requires-Python: >=3.7, !=3.9.*\n", "3.8"},
+		{"Requires-Python: >=3.6, !=3.9.1\n", defaultPythonVersion},
+		{"Requires-Python: ~=3.11\n", "3.11"},
+		{"Requires-Python: ~=3.8.1\n", "3.8"},
+		{"Requires-Python: >=3.13\n", "3.13"},
+	} {
+		if got := requiresPythonVersion([]byte(tc.metadata)); got != tc.want {
+			t.Errorf("requiresPythonVersion(%q) = %q, want %q", tc.metadata, got, tc.want)
+		}
+	}
+}
+
+func TestPythonSatisfies(t *testing.T) {
+	for _, tc := range []struct {
+		version string
+		spec    string
+		want    bool
+	}{
+		{"3.9", "", true},
+		{"3.9", ">=3.6", true},
+		{"3.9", ">=3.10", false},
+		{"3.9", ">3.9", false},
+		{"3.10", ">3.9", true},
+		{"3.9", "<3.9", false},
+		{"3.8", "<3.9", true},
+		{"3.9", "<=3.9", true},
+		{"3.9", "==3.9", true},
+		{"3.9", "==3.9.*", true},
+		{"3.10", "==3.9.*", false},
+		{"3.9", "!=3.9.*", false},
+		{"3.9", "==3.*", true},
+		{"3.9", "<4", true},
+		{"3.9", "~=3.8", true},
+		{"3.9", "!=3.9.1", true},
+		{"3.9", "==3.9.1", true},
+		{"3.9", ">3.9.1", true},
+		{"3.9", ">=3.9.1", true},
+		{"3.9", "~=3.9.1", true},
+		{"3.10", "~=3.9.1", false},
+		{"3.9", "~=3.8.1", false},
+		{"3.10", "~=3.8", true},
+		{"3.9", "<3.9.1", false},
+		{"3.8", "<3.9.1", true},
+		{"3.10", "!=3.9.1", true},
+		{"3.9", ">=3.6, !=3.7.*, <4", true},
+		{"3.7", ">=3.6, !=3.7.*, <4", false},
+	} {
+		if got := pythonSatisfies(tc.version, tc.spec); got != tc.want {
+			t.Errorf("pythonSatisfies(%q, %q) = %v, want %v", tc.version, tc.spec, got, tc.want)
+		}
+	}
+}
+
+func TestSetuptoolsVersion(t *testing.T) {
+	for _, tc := range []struct {
+		version  string
+		metadata string
+		want     string
+	}{
+		{"3.8", "Name: pkg\n", "==56.2.0"},
+		{"3.11", "Name: pkg\nLicense-File: LICENSE\n", "==58.3.0"},
+		{"3.12", "Name: pkg\n", "==68.2.2"},
+		{"3.12", "Name: pkg\nLicense-File: LICENSE\n", "==68.2.2"},
+	} {
+		if got := setuptoolsVersion(tc.version, []byte(tc.metadata)); got != tc.want {
+			t.Errorf("setuptoolsVersion(%q, %q) = %q, want %q", tc.version, tc.metadata, got, tc.want)
+		}
+	}
+}
+
+func TestDetectPythonVersion(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		hints        pythonHints
+		wantVersion  string
+		wantStrategy string
+	}{
+		{
+			name: "policy",
+			hints: pythonHints{
+				Override: "3.8",
+				Filename: "pkg-1.0-py311-none-any.whl",
+				Files:    []string{"pkg-1.0-py3.10-nspkg.pth"},
+			},
+			wantVersion:  "3.8",
+			wantStrategy: "policy",
+		},
+		{
+			name: "nspkg",
+			hints: pythonHints{
+				Filename: "pkg-1.0-py311-none-any.whl",
+				Files:    []string{"pkg/__init__.py", "pkg-1.0-py3.10-nspkg.pth", "pkg/__pycache__/mod.cpython-39.pyc"},
+			},
+			wantVersion:  "3.10",
+			wantStrategy: "nspkg",
+		},
+		{
+			name: "compiled_files",
+			hints: pythonHints{
+				Filename: "pkg-1.0-py311-none-any.whl",
+				Files:    []string{"pkg/__init__.py", "pkg/__pycache__/mod.cpython-39.pyc"},
+			},
+			wantVersion:  "3.9",
+			wantStrategy: "compiled_files",
+		},
+		{
+			name: "wheel_tag",
+			hints: pythonHints{
+				Filename: "pkg-1.0-py311-none-any.whl",
+				Files:    []string{"pkg/__init__.py"},
+				Metadata: []byte("Requires-Python: >=3.8\n"),
+			},
+			wantVersion:  "3.11",
+			wantStrategy: "wheel_tag",
+		},
+		{
+			name: "requires_python",
+			hints: pythonHints{
+				Filename:  "pkg-1.0-py3-none-any.whl",
+				Files:     []string{"pkg/__init__.py"},
+				Metadata:  []byte("Requires-Python: >=3.10\n"),
+				WheelInfo: []byte("Root-Is-Purelib: true\nTag: py3-none-any\n"),
+			},
+			wantVersion:  "3.10",
+			wantStrategy: "requires_python",
+		},
+		{
+			name: "default",
+			hints: pythonHints{
+				Filename:  "pkg-1.0-py3-none-any.whl",
+				Files:     []string{"pkg/__init__.py"},
+				Metadata:  []byte("Name: pkg\n"),
+				WheelInfo: []byte("Root-Is-Purelib: true\nTag: py3-none-any\n"),
+			},
+			wantVersion:  defaultPythonVersion,
+			wantStrategy: "default",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			version, strategy := detectPythonVersion(tc.hints)
+			if version != tc.wantVersion || strategy != tc.wantStrategy {
+				t.Errorf("detectPythonVersion() = (%q, %q), want (%q, %q)", version, strategy, tc.wantVersion, tc.wantStrategy)
+			}
+		})
+	}
+}
+
+func TestNspkgPythonVersion(t *testing.T) {
+	for _, tc := range []struct {
+		files []string
+		want  string
+	}{
+		{nil, ""},
+		{[]string{"pkg/__init__.py"}, ""},
+		{[]string{"zope.interface-5.4.0-py3.9-nspkg.pth"}, "3.9"},
+		{[]string{"pkg/__init__.py", "pkg_name-1.0-py3.12-nspkg.pth"}, "3.12"},
+		{[]string{"pkg-nspkg.pth"}, ""},
+	} {
+		if got := nspkgPythonVersion(tc.files); got != tc.want {
+			t.Errorf("nspkgPythonVersion(%q) = %q, want %q", tc.files, got, tc.want)
+		}
+	}
+}
+
+func TestCompiledPythonVersion(t *testing.T) {
+	for _, tc := range []struct {
+		files []string
+		want  string
+	}{
+		{nil, ""},
+		{[]string{"pkg/__init__.py", "pkg/data.so"}, ""},
+		{[]string{"pkg/__pycache__/__init__.cpython-38.pyc"}, "3.8"},
+		{[]string{"pkg/_speedups.cpython-311-x86_64-linux-gnu.so"}, "3.11"},
+		{[]string{"pkg/_speedups.cp310-win_amd64.pyd"}, "3.10"},
+	} {
+		if got := compiledPythonVersion(tc.files); got != tc.want {
+			t.Errorf("compiledPythonVersion(%q) = %q, want %q", tc.files, got, tc.want)
+		}
+	}
+}
@@ -4,10 +4,12 @@ import (
 	"archive/zip"
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -62,12 +64,34 @@ func getReleaseType(releaseFile string) ReleaseType {
 }
 
 type RebuilderOptions struct {
-	Types       []ReleaseType
-	PackageRoot *string
-	Version     *string
+	Types         []ReleaseType
+	PackageRoot   *string
+	Version       *string
+	PythonVersion *string
+	Normalize     []NormalizeStep
+	// IncludeSourceMetadata adds SourceMetadata for the tagged commit.
+	IncludeSourceMetadata bool
 }
 
-func Rebuild(pkg, repo string, opt RebuilderOptions) (*[]in_toto.ProvenanceStatement, error) {
+// RebuildResult describes the rebuild of a single release file.
+type RebuildResult struct {
+	Statement      in_toto.ProvenanceStatement
+	Filename       string
+	Version        string
+	Tag            string
+	Commit         string
+	BuildImage     string
+	PythonVersion  string
+	PythonStrategy string
+	// Reproduced is whether the rebuilt artifact matched the original.
+	Reproduced bool
+	Duration   time.Duration
+}
+
+// Rebuild rebuilds the release files of a package version from source.
+// When a rebuild produces a different artifact, the results of the rebuilds
+// attempted are returned alongside the error.
+func Rebuild(pkg, repo string, opt RebuilderOptions) (*[]RebuildResult, error) {
 	proj := pypiMetadata(pkg)
 	var version string
 	if opt.Version == nil || *opt.Version == "" {
@@ -89,27 +113,28 @@ func Rebuild(pkg, repo string, opt RebuilderOptions) (*[]in_toto.ProvenanceState
 		}
 	}
 	if len(toRebuild) == 0 {
-		return nil, fmt.Errorf("No release to rebuild [pkg=%s, types=%v]", pkg, opt.Types)
+		return nil, fmt.Errorf("%w [pkg=%s, types=%v]", ErrNoArtifacts, pkg, opt.Types)
 	}
 	// Find appropriate tag.
 	repoRe := regexp.MustCompile("github.com/([^/]*)/([^/]*)")
 	groups := repoRe.FindStringSubmatch(repo)
 	repoOwner, repoName := groups[1], groups[2]
-	re := regexp.MustCompile(fmt.Sprintf(`^(.*[^0-9])?%s([^abdp\-\.].*)?$`, version))
 	client := githubClient(*githubToken)
-	tags, _, err := client.Repositories.ListTags(context.Background(), repoOwner, repoName, nil)
+	tag, err := findTag(context.Background(), &client, repoOwner, repoName, version)
 	if err != nil {
 		return nil, err
 	}
-	var tag string
-	for _, t := range tags {
-		if re.MatchString(t.GetName()) {
-			tag = t.GetName()
-			break
-		}
-	}
 	if tag == "" {
-		return nil, fmt.Errorf("No tag found [pkg=%s, repo=%s, version=%s]", pkg, repo, version)
+		return nil, fmt.Errorf("%w [pkg=%s, repo=%s, version=%s]", ErrNoTag, pkg, repo, version)
+	}
+	commit, _, err := client.Repositories.GetCommitSHA1(context.Background(), repoOwner, repoName, tag, "")
+	if err != nil {
+		return nil, githubError(err, repoOwner, repoName)
+	}
+	var source *SourceMetadata
+	if opt.IncludeSourceMetadata {
+		md := fetchSourceMetadata(context.Background(), &client, repoOwner, repoName, commit, "")
+		source = &md
 	}
 	// Validate package root path.
 	var packageDir string
@@ -119,128 +144,213 @@ func Rebuild(pkg, repo string, opt RebuilderOptions) (*[]in_toto.ProvenanceState
 		packageDir = *opt.PackageRoot
 	}
 	file, _, _, err := client.Repositories.GetContents(context.Background(), repoOwner, repoName, filepath.Join(packageDir, "setup.py"), &github.RepositoryContentGetOptions{Ref: tag})
+	var perr *PermissionError
+	if errors.As(githubError(err, repoOwner, repoName), &perr) {
+		return nil, perr
+	}
 	if file == nil {
-		return nil, fmt.Errorf("No setup.py file found in package root [pkg=%s, repo=%s, tag=%s, path=%s]", pkg, repo, tag, packageDir)
+		return nil, fmt.Errorf("%w [pkg=%s, repo=%s, tag=%s, path=%s]", ErrNoSetupPy, pkg, repo, tag, packageDir)
+	}
+	var pythonOverride string
+	if opt.PythonVersion != nil {
+		pythonOverride = *opt.PythonVersion
 	}
 	// Do rebuilds.
-	var stmts []in_toto.ProvenanceStatement
+	var results []RebuildResult
 	for _, r := range toRebuild {
 		switch getReleaseType(r.Filename) {
 		case wheelAny:
-			prov, err := rebuildWheel(r, pkg, repo, tag, packageDir)
+			result, err := rebuildWheel(r, pkg, repo, tag, commit, packageDir, pythonOverride, opt.Normalize, source)
+			if result != nil {
+				result.Version = version
+				results = append(results, *result)
+			}
 			if err != nil {
-				return nil, err
+				return &results, err
 			}
-			stmts = append(stmts, *prov)
 		default:
-			return nil, fmt.Errorf("Release type not supported [pkg=%s, version=%s, type=%v]", pkg, version, getReleaseType(r.Filename))
+			return nil, fmt.Errorf("%w [pkg=%s, version=%s, type=%v]", ErrUnsupportedRelease, pkg, version, getReleaseType(r.Filename))
+		}
+	}
+	return &results, nil
+}
+
+// findTag returns the name of the repo's tag for the version, or the empty
+// string if there is none.
+func findTag(ctx context.Context, c *github.Client, owner, repo, version string) (string, error) {
+	re := regexp.MustCompile(fmt.Sprintf(`^(.*[^0-9])?%s([^abdp\-\.].*)?$`, version))
+	tagOpts := &github.ListOptions{PerPage: 100}
+	for {
+		tags, resp, err := c.Repositories.ListTags(ctx, owner, repo, tagOpts)
+		if err != nil {
+			return "", githubError(err, owner, repo)
+		}
+		for _, t := range tags {
+			if re.MatchString(t.GetName()) {
+				return t.GetName(), nil
+			}
+		}
+		if resp.NextPage == 0 {
+			return "", nil
 		}
+		tagOpts.Page = resp.NextPage
+	}
+}
+
+// rebuildSteps returns the Cloud Build steps that rebuild a wheel and compare
+// it with the original. The normalization steps, which run just before the
+// comparison, are also returned on their own so they can be recorded.
+func rebuildSteps(buildImage string, normalize []NormalizeStep) (steps, normalization []*cloudbuild.BuildStep) {
+	steps = []*cloudbuild.BuildStep{
+		&cloudbuild.BuildStep{
+			Name: "gcr.io/cloud-builders/git",
+			Args: []string{"clone", "--branch", "${_TAG}", "--single-branch", "https://${_REPO}", "repo"},
+		},
+		&cloudbuild.BuildStep{
+			Name: "gcr.io/cloud-builders/curl",
+			Args: []string{"--output", "${_FILENAME}", "${_URL}"},
+		},
+		&cloudbuild.BuildStep{
+			Name:       buildImage,
+			Entrypoint: "/bin/sh",
+			Args: []string{"-c", `
+				apk add git &&
+    			mkdir env &&
+    			python${_PYTHON} -m venv env &&
+    			env/bin/pip3 install setuptools${_SETUPTOOLS} wheel${_WHEEL} &&
+    			cd repo/${_PACKAGEROOT} &&
+    			/workspace/env/bin/python${_PYTHON} setup.py build bdist_wheel
+		`},
+		},
+	}
+	normalization = []*cloudbuild.BuildStep{{
+		Name: "gcr.io/" + *project + "/transfer_metadata",
+		Args: []string{"${_FILENAME}", "repo/${_PACKAGEROOT}/dist/${_FILENAME}"},
+	}}
+	for _, n := range normalize {
+		image := n.Image
+		if image == "" {
+			image = buildImage
+		}
+		normalization = append(normalization, &cloudbuild.BuildStep{
+			Name:       image,
+			Entrypoint: "/bin/sh",
+			Env:        []string{"ORIGINAL=${_FILENAME}", "REBUILT=repo/${_PACKAGEROOT}/dist/${_FILENAME}"},
+			// Escape the command from Cloud Build's substitutions.
+			Args: []string{"-c", strings.ReplaceAll(n.Command, "$", "$$")},
+		})
+	}
+	steps = append(steps, normalization...)
+	steps = append(steps, &cloudbuild.BuildStep{
+		Id:         "compare",
+		Name:       buildImage,
+		Entrypoint: "/bin/sh",
+		Args: []string{"-c", `
+				apk add libmagic libarchive unzip &&
+				env/bin/pip3 install diffoscope &&
+				env/bin/diffoscope ${_FILENAME} repo/${_PACKAGEROOT}/dist/${_FILENAME}
+		`},
+	})
+	return steps, normalization
+}
+
+// NormalizationStep records a normalization step as it was run by Cloud Build.
+type NormalizationStep struct {
+	Image      string   `json:"image"`
+	Entrypoint string   `json:"entrypoint,omitempty"`
+	Args       []string `json:"args"`
+	Env        []string `json:"env,omitempty"`
+}
+
+// executedStep returns the step with Cloud Build's substitutions applied.
+func executedStep(step *cloudbuild.BuildStep, substitutions map[string]string) NormalizationStep {
+	expand := func(s string) string {
+		return os.Expand(s, func(name string) string {
+			// $$ is an escaped $.
+			if name == "$" {
+				return "$"
+			}
+			return substitutions[name]
+		})
+	}
+	executed := NormalizationStep{Image: step.Name, Entrypoint: step.Entrypoint}
+	for _, arg := range step.Args {
+		executed.Args = append(executed.Args, expand(arg))
+	}
+	for _, env := range step.Env {
+		executed.Env = append(executed.Env, expand(env))
 	}
-	return &stmts, nil
+	return executed
 }
 
-func rebuildWheel(wheel Release, pkg, repo, tag, packageRoot string) (*in_toto.ProvenanceStatement, error) {
+func rebuildWheel(wheel Release, pkg, repo, tag, commit, packageRoot, pythonOverride string, normalize []NormalizeStep, source *SourceMetadata) (*RebuildResult, error) {
 	start := time.Now()
 	origWhl := get(wheel.URL)
 	r, err := zip.NewReader(bytes.NewReader(origWhl), int64(len(origWhl)))
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("%w [file=%s]: %v", ErrMalformedWheel, wheel.Filename, err)
 	}
 	var metadata, wheelInfo []byte
-	python := "python3.9"
+	var files []string
 	for _, f := range r.File {
+		files = append(files, f.Name)
 		switch {
 		case strings.HasSuffix(f.Name, ".dist-info/METADATA"):
-			reader, err := f.Open()
-			if err != nil {
-				log.Fatal(err)
-			}
-			metadata, err = ioutil.ReadAll(reader)
-			if err != nil {
-				log.Fatal(err)
-			}
+			metadata, err = readZipFile(f)
 		case strings.HasSuffix(f.Name, ".dist-info/WHEEL"):
-			reader, err := f.Open()
-			if err != nil {
-				log.Fatal(err)
-			}
-			wheelInfo, err = ioutil.ReadAll(reader)
-			if err != nil {
-				log.Fatal(err)
-			}
-		case strings.HasSuffix(f.Name, "-nspkg.pth"):
-			// Names of the form: "pkg_name-version-py3.10-nspkg.pth"
-			pthRe := regexp.MustCompile(`[^-]+-[^-]+-py(\d+\.\d+)-nspkg.pth`)
-			segs := pthRe.FindStringSubmatch(f.Name)
-			if len(segs) == 0 {
-				break
-			}
-			version := segs[1]
-			// XXX: alpine pkg constraint
-			if version != "3.9" {
-				return nil, errors.New("Unsupported python version")
-			}
-			python = "python" + version
+			wheelInfo, err = readZipFile(f)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w [file=%s, path=%s]: %v", ErrMalformedWheel, wheel.Filename, f.Name, err)
 		}
 	}
 	if len(metadata) == 0 {
-		log.Fatal("No METADATA found")
+		return nil, fmt.Errorf("%w [file=%s]: No METADATA found", ErrMalformedWheel, wheel.Filename)
+	}
+	pythonVersion, strategy := detectPythonVersion(pythonHints{
+		Override:  pythonOverride,
+		Filename:  wheel.Filename,
+		Files:     files,
+		Metadata:  metadata,
+		WheelInfo: wheelInfo,
+	})
+	log.Printf("Detected python version [file=%s version=%s strategy=%s]", wheel.Filename, pythonVersion, strategy)
+	if !isSupportedPython(pythonVersion) {
+		return nil, fmt.Errorf("%w [pkg=%s, file=%s, version=%s, strategy=%s, supported=%v]", ErrUnsupportedPython, pkg, wheel.Filename, pythonVersion, strategy, supportedPythonVersions)
 	}
+	python := "python" + pythonVersion
+	buildImage := fmt.Sprintf("python:%s-alpine", pythonVersion)
 	deps := make(map[string]string, 2)
 	re := regexp.MustCompile(`Generator: bdist_wheel \(([\.\d]*)\)`)
-	deps["wheel"] = "==" + string(re.FindSubmatch(wheelInfo)[1])
-	switch {
-	case bytes.Contains(metadata, []byte("License-File")):
-		deps["setuptools"] = "==58.3.0"
-	default:
-		deps["setuptools"] = "==56.2.0"
+	generator := re.FindSubmatch(wheelInfo)
+	if generator == nil {
+		return nil, fmt.Errorf("%w [pkg=%s, file=%s]", ErrUnsupportedGenerator, pkg, wheel.Filename)
+	}
+	deps["wheel"] = "==" + string(generator[1])
+	deps["setuptools"] = setuptoolsVersion(pythonVersion, metadata)
+	substitutions := map[string]string{
+		"_FILENAME":    wheel.Filename,
+		"_URL":         wheel.URL,
+		"_REPO":        repo,
+		"_TAG":         tag,
+		"_SETUPTOOLS":  deps["setuptools"],
+		"_WHEEL":       deps["wheel"],
+		"_PACKAGEROOT": packageRoot,
+		"_PYTHON":      pythonVersion,
+	}
+	steps, normalizeSteps := rebuildSteps(buildImage, normalize)
+	normalization := make([]NormalizationStep, 0, len(normalizeSteps))
+	for _, step := range normalizeSteps {
+		normalization = append(normalization, executedStep(step, substitutions))
 	}
 	svc, err := cloudbuild.NewService(context.Background())
+	if err != nil {
+		return nil, err
+	}
 	op, err := svc.Projects.Builds.Create(*project, &cloudbuild.Build{
-		Substitutions: map[string]string{
-			"_FILENAME":    wheel.Filename,
-			"_URL":         wheel.URL,
-			"_REPO":        repo,
-			"_TAG":         tag,
-			"_SETUPTOOLS":  deps["setuptools"],
-			"_WHEEL":       deps["wheel"],
-			"_PACKAGEROOT": packageRoot,
-		},
-		Steps: []*cloudbuild.BuildStep{
-			&cloudbuild.BuildStep{
-				Name: "gcr.io/cloud-builders/git",
-				Args: []string{"clone", "--branch", "${_TAG}", "--single-branch", "https://${_REPO}", "repo"},
-			},
-			&cloudbuild.BuildStep{
-				Name: "gcr.io/cloud-builders/curl",
-				Args: []string{"--output", "${_FILENAME}", "${_URL}"},
-			},
-			&cloudbuild.BuildStep{
-				Name:       "alpine",
-				Entrypoint: "/bin/sh",
-				Args: []string{"-c", `
-					apk add python3 py3-pip git &&
-    			mkdir env &&
-    			python3 -m venv env &&
-    			env/bin/pip3 install setuptools${_SETUPTOOLS} wheel${_WHEEL} &&
-    			cd repo/${_PACKAGEROOT} &&
-    			/workspace/env/bin/python3.9 setup.py build bdist_wheel
-			`},
-			},
-			&cloudbuild.BuildStep{
-				Name: "gcr.io/" + *project + "/transfer_metadata",
-				Args: []string{"${_FILENAME}", "repo/${_PACKAGEROOT}/dist/${_FILENAME}"},
-			},
-			&cloudbuild.BuildStep{
-				Name:       "alpine",
-				Entrypoint: "/bin/sh",
-				Args: []string{"-c", `
-					apk add python3 py3-pip libmagic libarchive unzip &&
-					env/bin/pip3 install diffoscope &&
-					env/bin/diffoscope ${_FILENAME} repo/${_PACKAGEROOT}/dist/${_FILENAME}
-			`},
-			},
-		}}).Do()
+		Substitutions: substitutions,
+		Steps:         steps,
+	}).Do()
 	if err != nil {
 		return nil, err
 	}
@@ -248,24 +358,40 @@ func rebuildWheel(wheel Release, pkg, repo, tag, packageRoot string) (*in_toto.P
 		time.Sleep(10 * time.Second)
 		op, err = svc.Operations.Get(op.Name).Do()
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 	}
 	end := time.Now()
+	result := RebuildResult{
+		Filename:       wheel.Filename,
+		Tag:            tag,
+		Commit:         commit,
+		BuildImage:     buildImage,
+		PythonVersion:  pythonVersion,
+		PythonStrategy: strategy,
+		Duration:       end.Sub(start),
+	}
 	if op.Error != nil {
+		md := cloudbuild.BuildOperationMetadata{}
+		if err := json.Unmarshal(op.Metadata, &md); err == nil && md.Build != nil {
+			for _, step := range md.Build.Steps {
+				if step.Id == "compare" && step.Status == "FAILURE" {
+					return &result, fmt.Errorf("%w [pkg=%s, file=%s, build=%s]", ErrRebuildDiffs, pkg, wheel.Filename, md.Build.Id)
+				}
+			}
+		}
 		errTxt, err := op.Error.MarshalJSON()
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 		return nil, errors.New(string(errTxt))
 	}
-	// Construct and return SLSA provenance.
-	c := githubClient(*githubToken)
-	parts := strings.Split(repo, "/")
-	hash, _, err := c.Repositories.GetCommitSHA1(context.Background(), parts[1], parts[2], tag, "")
-	if err != nil {
-		log.Fatal(err)
+	result.Reproduced = true
+	env := map[string]interface{}{"normalization": normalization}
+	if source != nil {
+		env["sourceMetadata"] = *source
 	}
+	// Construct and return SLSA provenance.
 	stmt := in_toto.ProvenanceStatement{
 		in_toto.StatementHeader{
 			Type:          "https://in-toto.io/Statement/v0.1",
@@ -284,7 +410,7 @@ func rebuildWheel(wheel Release, pkg, repo, tag, packageRoot string) (*in_toto.P
 					fmt.Sprintf("cd %s", packageRoot),
 					fmt.Sprintf("/tmp/env/bin/%s setup.py build bdist_wheel", python),
 				},
-				Environment: []string{},
+				Environment: env,
 			},
 			&in_toto.ProvenanceMetadata{
 				BuildStartedOn:  &start,
@@ -295,10 +421,20 @@ func rebuildWheel(wheel Release, pkg, repo, tag, packageRoot string) (*in_toto.P
 			[]in_toto.ProvenanceMaterial{
 				{
 					URI:    fmt.Sprintf("git+https://%s@%s", repo, tag),
-					Digest: in_toto.DigestSet{"sha1": hash},
+					Digest: in_toto.DigestSet{"sha1": commit},
 				},
 			},
 		},
 	}
-	return &stmt, nil
+	result.Statement = stmt
+	return &result, nil
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	reader, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
 }
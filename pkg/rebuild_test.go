@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestFindTagPaginates(t *testing.T) {
+	var lastPage int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/o/r/tags", func(rw http.ResponseWriter, req *http.Request) {
+		lastPage = servePage(rw, req, 4)
+		var tags []map[string]string
+		switch lastPage {
+		case 1:
+			tags = []map[string]string{{"name": "v1.0.1"}, {"name": "v1.0a1"}}
+		case 2:
+			tags = []map[string]string{{"name": "v11.0"}, {"name": "v0.9"}}
+		case 3:
+			tags = []map[string]string{{"name": "v0.8"}, {"name": "v1.0"}}
+		case 4:
+			tags = []map[string]string{{"name": "v0.2"}}
+		}
+		json.NewEncoder(rw).Encode(tags)
+	})
+	c, _ := testGitHubClient(t, mux)
+	for _, tc := range []struct {
+		version  string
+		want     string
+		wantPage int
+	}{
+		{"1.0", "v1.0", 3},
+		{"0.2", "v0.2", 4},
+		{"2.0", "", 4},
+	} {
+		tag, err := findTag(context.Background(), c, "o", "r", tc.version)
+		if err != nil {
+			t.Fatalf("findTag(%q) = %v", tc.version, err)
+		}
+		if tag != tc.want {
+			t.Errorf("findTag(%q) = %q, want %q", tc.version, tag, tc.want)
+		}
+		if lastPage != tc.wantPage {
+			t.Errorf("findTag(%q) stopped at page %d, want %d", tc.version, lastPage, tc.wantPage)
+		}
+	}
+}
+
+func TestRebuildSteps(t *testing.T) {
+	defer func(p string) { *project = p }(*project)
+	*project = "test"
+	const buildImage = "python:3.9-alpine"
+	transferMetadata := NormalizationStep{
+		Image: "gcr.io/test/transfer_metadata",
+		Args:  []string{"idna-3.3-py3-none-any.whl", "repo/src/dist/idna-3.3-py3-none-any.whl"},
+	}
+	env := []string{"ORIGINAL=idna-3.3-py3-none-any.whl", "REBUILT=repo/src/dist/idna-3.3-py3-none-any.whl"}
+	for _, tc := range []struct {
+		name      string
+		normalize []NormalizeStep
+		args      [][]string
+		want      []NormalizationStep
+	}{
+		{
+			name: "default",
+			want: []NormalizationStep{transferMetadata},
+		},
+		{
+			name: "policy steps",
+			normalize: []NormalizeStep{
+				{Command: `sed -i "s/${VERSION}//" $REBUILT`},
+				{Image: "alpine", Command: "unzip -l $ORIGINAL"},
+			},
+			args: [][]string{
+				{"-c", `sed -i "s/$${VERSION}//" $$REBUILT`},
+				{"-c", "unzip -l $$ORIGINAL"},
+			},
+			want: []NormalizationStep{
+				transferMetadata,
+				{Image: buildImage, Entrypoint: "/bin/sh", Args: []string{"-c", `sed -i "s/${VERSION}//" $REBUILT`}, Env: env},
+				{Image: "alpine", Entrypoint: "/bin/sh", Args: []string{"-c", "unzip -l $ORIGINAL"}, Env: env},
+			},
+		},
+		{
+			name:      "escaped dollar",
+			normalize: []NormalizeStep{{Command: "echo $$"}},
+			args:      [][]string{{"-c", "echo $$$$"}},
+			want: []NormalizationStep{
+				transferMetadata,
+				{Image: buildImage, Entrypoint: "/bin/sh", Args: []string{"-c", "echo $$"}, Env: env},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			steps, normalization := rebuildSteps(buildImage, tc.normalize)
+			if len(normalization) != len(tc.normalize)+1 {
+				t.Fatalf("rebuildSteps() returned %d normalization steps, want %d", len(normalization), len(tc.normalize)+1)
+			}
+			// Normalization runs immediately before the comparison.
+			n := len(steps)
+			if steps[n-1].Id != "compare" {
+				t.Errorf("Last step = %q, want compare", steps[n-1].Id)
+			}
+			if got := steps[n-1-len(normalization) : n-1]; !reflect.DeepEqual(got, normalization) {
+				t.Errorf("Steps before compare = %+v, want %+v", got, normalization)
+			}
+			for i, args := range tc.args {
+				if got := normalization[i+1].Args; !reflect.DeepEqual(got, args) {
+					t.Errorf("Step %d args = %q, want %q", i+1, got, args)
+				}
+			}
+			substitutions := map[string]string{"_FILENAME": "idna-3.3-py3-none-any.whl", "_PACKAGEROOT": "src"}
+			var got []NormalizationStep
+			for _, step := range normalization {
+				got = append(got, executedStep(step, substitutions))
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("executed steps = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
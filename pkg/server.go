@@ -2,13 +2,14 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strings"
 	"time"
 
@@ -40,19 +41,18 @@ func HandleUpload(rw http.ResponseWriter, req *http.Request) {
 	policy, err := fetchPolicy(&gh, scope, pkg, "main")
 	if err != nil {
 		log.Println(err)
-		http.Error(rw, "Failed to fetch policy", 500)
+		code, msg := errorResponse(err, "Failed to fetch policy")
+		http.Error(rw, msg, code)
 		return
 	}
 	if policy.ProvenanceUpload == nil {
 		http.Error(rw, "Policy does not define provenance_upload", 400)
 		return
 	}
-	var match bool
-	for _, authorized := range policy.ProvenanceUpload.AuthorizedBuilders {
-		match = match || authorized == email
-	}
-	if !match {
-		http.Error(rw, "Builder not authorized", 403)
+	if err := authorizeBuilder(policy.ProvenanceUpload, email); err != nil {
+		log.Println(err)
+		code, msg := errorResponse(err, "Failed to authorize builder")
+		http.Error(rw, msg, code)
 		return
 	}
 	stmt := in_toto.ProvenanceStatement{}
@@ -60,6 +60,19 @@ func HandleUpload(rw http.ResponseWriter, req *http.Request) {
 		http.Error(rw, "Malformed provenance", 400)
 		return
 	}
+	proj, err := fetchProject(pkg)
+	if err != nil {
+		log.Println(err)
+		code, msg := errorResponse(err, "Failed to fetch package metadata")
+		http.Error(rw, msg, code)
+		return
+	}
+	if err := validateSubjects(stmt.Subject, proj.Releases[version]); err != nil {
+		log.Println(err)
+		code, msg := errorResponse(err, "Failed to validate subjects")
+		http.Error(rw, msg, code)
+		return
+	}
 	stmtBytes, err := in_toto.EncodeCanonical(stmt)
 	if err != nil {
 		http.Error(rw, "Failed to canonicalize provenance", 400)
@@ -91,6 +104,15 @@ func HandleUpload(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func authorizeBuilder(upload *ProvenanceUpload, email string) error {
+	for _, authorized := range upload.AuthorizedBuilders {
+		if authorized == email {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w [email=%s]", ErrBuilderNotAuthorized, email)
+}
+
 func authenticatedUser(r *http.Request) (email string, userID string, err error) {
 	assertion := strings.TrimPrefix(r.Header.Get("Authorization"), "bearer ")
 	if len(assertion) == 0 {
@@ -119,7 +141,8 @@ func HandleRebuild(rw http.ResponseWriter, req *http.Request) {
 	policy, err := fetchPolicy(&gh, scope, pkg, ref)
 	if err != nil {
 		log.Println(err)
-		http.Error(rw, "Failed to fetch policy", 500)
+		code, msg := errorResponse(err, "Failed to fetch policy")
+		http.Error(rw, msg, code)
 		return
 	}
 	if policy.Rebuilder == nil {
@@ -131,6 +154,20 @@ func HandleRebuild(rw http.ResponseWriter, req *http.Request) {
 		http.Error(rw, "Internal Error", 500)
 		return
 	}
+	record, err := rebuildVersion(ctx, client, policy, pkg, version)
+	if err != nil {
+		log.Println(err)
+		code, msg := errorResponse(err, "Failed to rebuild")
+		http.Error(rw, msg, code)
+	}
+	if _, _, err = client.Collection("rebuilds").Add(ctx, record); err != nil {
+		log.Println("Failed to write record")
+	}
+}
+
+// rebuildVersion rebuilds and attests to a package version. The returned
+// record describes the outcome and, on failure, is accompanied by the error.
+func rebuildVersion(ctx context.Context, client *firestore.Client, policy *Policy, pkg, version string) (map[string]interface{}, error) {
 	record := map[string]interface{}{
 		"package":          pkg,
 		"version":          version,
@@ -141,65 +178,78 @@ func HandleRebuild(rw http.ResponseWriter, req *http.Request) {
 		"start_time":       time.Now(),
 		"end_time":         time.Now(),
 	}
-	stmts, err := Rebuild(pkg, policy.Repo, RebuilderOptions{
-		Version:     &version,
-		PackageRoot: &policy.Rebuilder.PackageRoot,
-		Types:       []ReleaseType{wheelAny},
+	results, err := Rebuild(pkg, policy.Repo, RebuilderOptions{
+		Version:               &version,
+		PackageRoot:           &policy.Rebuilder.PackageRoot,
+		PythonVersion:         &policy.Rebuilder.PythonVersion,
+		Normalize:             policy.Rebuilder.Normalize,
+		IncludeSourceMetadata: policy.IncludeSourceMetadata,
+		Types:                 []ReleaseType{wheelAny},
 	})
 	record["end_time"] = time.Now()
+	if results != nil && len(*results) > 0 {
+		result := (*results)[len(*results)-1]
+		record["tag"] = result.Tag
+		record["commit"] = result.Commit
+		record["build_image"] = result.BuildImage
+		record["python_version"] = result.PythonVersion
+		record["reproduced"] = result.Reproduced
+		record["duration"] = result.Duration.Seconds()
+	}
 	switch {
-	case err != nil && strings.HasPrefix(err.Error(), "Rebuild contained diffs"):
-		log.Println(err)
-		http.Error(rw, "Rebuild contained diffs", 409)
+	case errors.Is(err, ErrRebuildDiffs):
 		record["status"] = "failed"
 		record["message"] = err.Error()
+		return record, err
 	case err != nil:
-		log.Println(err)
-		http.Error(rw, "Failed to rebuild", 500)
+		_, msg := errorResponse(err, "Failed to rebuild")
 		record["status"] = "error"
-		record["message"] = "Failed to rebuild"
-	case stmts == nil && len(*stmts) == 0:
-		http.Error(rw, "No artifacts to rebuild", 404)
+		record["message"] = msg
+		return record, err
+	case results == nil || len(*results) == 0:
 		record["status"] = "failure"
 		record["message"] = "No artifacts to rebuild"
-	default:
-		if len(*stmts) != 1 {
-			log.Fatalln("Unexpected returned statements")
-		}
-		builtVersion := strings.Split(filepath.Base((*stmts)[0].Subject[0].Name), "-")[1]
-		switch {
-		case version == "":
-			record["version"] = builtVersion
-		case builtVersion != version:
-			log.Fatalln("Requested version differs from actual")
-		}
-		stmtBytes, err := in_toto.EncodeCanonical((*stmts)[0])
-		if err != nil {
-			log.Fatalln(err)
-		}
-		dsse, err := NewDSSE(stmtBytes)
-		if err != nil {
-			log.Fatalln(err)
-		}
-		dsseBytes, err := json.Marshal(dsse)
-		if err != nil {
-			log.Fatalln(err)
-		}
-		_, err = client.Collection("attestations").Doc(pkg+"!"+record["version"].(string)).Set(ctx, map[string]interface{}{
-			"package": pkg,
-			"version": record["version"].(string),
-			"raw":     string(stmtBytes),
-			"dsse":    string(dsseBytes),
-		})
-		if err != nil {
-			http.Error(rw, "Internal Error", 500)
-			return
-		}
-		record["status"] = "success"
+		return record, ErrNoArtifacts
 	}
-	if _, _, err = client.Collection("rebuilds").Add(ctx, record); err != nil {
-		log.Println("Failed to write record")
+	if len(*results) != 1 {
+		record["status"] = "error"
+		record["message"] = "Unexpected number of rebuilt files"
+		return record, fmt.Errorf("Unexpected number of rebuilt files [pkg=%s, version=%s, files=%d]", pkg, version, len(*results))
+	}
+	if version == "" {
+		record["version"] = (*results)[0].Version
+	}
+	if err := storeAttestation(ctx, client, pkg, record["version"].(string), (*results)[0].Statement); err != nil {
+		record["status"] = "error"
+		record["message"] = "Failed to store attestation"
+		return record, err
 	}
+	record["status"] = "success"
+	return record, nil
+}
+
+// storeAttestation signs the statement and stores it as the attestation for
+// the package version.
+func storeAttestation(ctx context.Context, client *firestore.Client, pkg, version string, stmt in_toto.ProvenanceStatement) error {
+	stmtBytes, err := in_toto.EncodeCanonical(stmt)
+	if err != nil {
+		return err
+	}
+	dsse, err := NewDSSE(stmtBytes)
+	if err != nil {
+		return err
+	}
+	dsseBytes, err := json.Marshal(dsse)
+	if err != nil {
+		return err
+	}
+	_, err = client.Collection("attestations").Doc(pkg+"!"+version).Set(ctx, map[string]interface{}{
+		"package": pkg,
+		"version": version,
+		"raw":     string(stmtBytes),
+		"dsse":    string(dsseBytes),
+	})
+	return err
 }
 
 func HandleMonitor(rw http.ResponseWriter, req *http.Request) {
@@ -213,7 +263,8 @@ func HandleMonitor(rw http.ResponseWriter, req *http.Request) {
 	policy, err := fetchPolicy(&gh, scope, pkg, ref)
 	if err != nil {
 		log.Println(err)
-		http.Error(rw, "Failed to fetch policy", 500)
+		code, msg := errorResponse(err, "Failed to fetch policy")
+		http.Error(rw, msg, code)
 		return
 	}
 	if policy.BuildMonitor == nil {
@@ -235,52 +286,39 @@ func HandleMonitor(rw http.ResponseWriter, req *http.Request) {
 		"start_time":       time.Now(),
 		"end_time":         time.Now(),
 	}
-	stmt, err := MonitorBuild(pkg, policy.Repo, MonitorOptions{policy.BuildMonitor.GitHubActions, &version})
+	result, err := MonitorBuild(pkg, policy.Repo, MonitorOptions{
+		GitHubActions:         policy.BuildMonitor.GitHubActions,
+		Version:               &version,
+		IncludeSourceMetadata: policy.IncludeSourceMetadata,
+	})
 	record["end_time"] = time.Now()
+	if result != nil {
+		record["workflow"] = result.Workflow
+		record["run_id"] = result.RunID
+		record["commit"] = result.Commit
+		record["branch"] = result.Branch
+		record["duration"] = result.Duration.Seconds()
+		record["coverage_complete"] = result.Coverage.Complete
+		record["covered_files"] = result.Coverage.Covered
+		record["missing_files"] = result.Coverage.Missing
+	}
 	switch {
 	case err != nil:
 		log.Println(err)
-		http.Error(rw, "Failed to monitor build", 500)
+		code, msg := errorResponse(err, "Failed to monitor build")
+		http.Error(rw, msg, code)
 		record["status"] = "error"
-		record["message"] = "Failed to monitor build"
-	case stmt == nil:
+		record["message"] = msg
+	case result == nil:
 		http.Error(rw, "No build found", 404)
 		record["status"] = "failure"
 		record["message"] = "No build found"
 	default:
-		var builtVersion string
-		for _, subj := range stmt.Subject {
-			if !strings.HasSuffix(subj.Name, ".whl") {
-				continue
-			}
-			builtVersion = strings.Split(filepath.Base(subj.Name), "-")[1]
-			break
-		}
-		switch {
-		case version == "":
-			record["version"] = builtVersion
-		case builtVersion != version:
-			log.Fatalln("Requested version differs from actual")
-		}
-		stmtBytes, err := in_toto.EncodeCanonical(stmt)
-		if err != nil {
-			log.Fatal(err)
-		}
-		dsse, err := NewDSSE(stmtBytes)
-		if err != nil {
-			log.Fatal(err)
-		}
-		dsseBytes, err := json.Marshal(dsse)
-		if err != nil {
-			log.Fatalln(err)
+		if version == "" {
+			record["version"] = result.Version
 		}
-		_, err = client.Collection("attestations").Doc(pkg+"!"+record["version"].(string)).Set(ctx, map[string]interface{}{
-			"package": pkg,
-			"version": record["version"].(string),
-			"raw":     string(stmtBytes),
-			"dsse":    string(dsseBytes),
-		})
-		if err != nil {
+		if err := storeAttestation(ctx, client, pkg, record["version"].(string), result.Statement); err != nil {
+			log.Println(err)
 			http.Error(rw, "Internal Error", 500)
 			return
 		}
@@ -290,18 +328,43 @@ func HandleMonitor(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// HandleGet returns the stored provenance for a package version. If the
+// version is omitted, that of the latest release on PyPI is returned.
 func HandleGet(rw http.ResponseWriter, req *http.Request) {
 	ctx := context.Background()
 	req.ParseForm()
 	// FIXME encode scope in docref
 	_, pkg, version := req.Form.Get("scope"), req.Form.Get("pkg"), req.Form.Get("version")
+	if pkg == "" {
+		http.Error(rw, "Missing pkg parameter", 400)
+		return
+	}
+	latest := version == ""
+	if latest {
+		var err error
+		version, err = latestVersion(pkg)
+		switch {
+		case errors.Is(err, ErrUnknownPackage):
+			http.Error(rw, fmt.Sprintf("Unknown package %s", pkg), 404)
+			return
+		case err != nil:
+			log.Println(err)
+			code, msg := errorResponse(err, "Failed to resolve latest version")
+			http.Error(rw, msg, code)
+			return
+		}
+	}
 	client, err := firestore.NewClient(ctx, *project)
 	if err != nil {
 		http.Error(rw, "Internal Error", 500)
 		return
 	}
 	snapshot, err := client.Collection("attestations").Doc(pkg + "!" + version).Get(ctx)
-	if err != nil {
+	switch {
+	case err != nil && latest:
+		http.Error(rw, fmt.Sprintf("No attestation found for latest version %s", version), 404)
+		return
+	case err != nil:
 		http.Error(rw, "Not Found", 404)
 		return
 	}
@@ -334,6 +397,58 @@ func HandleGet(rw http.ResponseWriter, req *http.Request) {
 	rw.Write(ret)
 }
 
+// HandleVerify checks the signature of a DSSE envelope and, if valid, returns
+// the statement it contains. The envelope may be provided directly using the
+// `dsse` parameter or, if omitted, is read from the stored attestation.
+func HandleVerify(rw http.ResponseWriter, req *http.Request) {
+	ctx := context.Background()
+	req.ParseForm()
+	// FIXME encode scope in docref
+	_, pkg, version, envelope := req.Form.Get("scope"), req.Form.Get("pkg"), req.Form.Get("version"), req.Form.Get("dsse")
+	if envelope == "" {
+		client, err := firestore.NewClient(ctx, *project)
+		if err != nil {
+			http.Error(rw, "Internal Error", 500)
+			return
+		}
+		snapshot, err := client.Collection("attestations").Doc(pkg + "!" + version).Get(ctx)
+		if err != nil {
+			http.Error(rw, "Not Found", 404)
+			return
+		}
+		envelope = snapshot.Data()["dsse"].(string)
+	}
+	dsse := DSSE{}
+	if err := json.Unmarshal([]byte(envelope), &dsse); err != nil {
+		code, msg := errorResponse(fmt.Errorf("%w: %v", ErrMalformedDSSE, err), "Failed to verify")
+		http.Error(rw, msg, code)
+		return
+	}
+	if err := VerifyDSSE(dsse); err != nil {
+		log.Println(err)
+		code, msg := errorResponse(err, "Failed to verify")
+		http.Error(rw, msg, code)
+		return
+	}
+	payload, err := base64.StdEncoding.DecodeString(dsse.Payload)
+	if err != nil {
+		code, msg := errorResponse(fmt.Errorf("%w: %v", ErrMalformedDSSE, err), "Failed to verify")
+		http.Error(rw, msg, code)
+		return
+	}
+	stmt := in_toto.ProvenanceStatement{}
+	if err := json.Unmarshal(payload, &stmt); err != nil {
+		http.Error(rw, "Malformed provenance", 422)
+		return
+	}
+	ret, err := json.Marshal(stmt)
+	if err != nil {
+		http.Error(rw, "Internal Error", 500)
+		return
+	}
+	rw.Write(ret)
+}
+
 type Provenance struct {
 	Package string `json:"package"`
 	Version string `json:"version"`
@@ -344,9 +459,12 @@ type Provenance struct {
 func main() {
 	flag.Parse()
 	http.HandleFunc("/rebuild", HandleRebuild)
+	http.HandleFunc("/batch_rebuild", HandleBatchRebuild)
+	http.HandleFunc("/batch_progress", HandleBatchProgress)
 	http.HandleFunc("/monitor", HandleMonitor)
 	http.HandleFunc("/upload", HandleUpload)
 	http.HandleFunc("/get", HandleGet)
+	http.HandleFunc("/verify", HandleVerify)
 	if err := http.ListenAndServe(":8080", nil); err != nil {
 		log.Fatalln(err)
 	}
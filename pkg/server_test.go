@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testPyPI serves PyPI JSON API responses from handler for the duration of
+// the test.
+func testPyPI(t *testing.T, handler http.Handler) {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	orig := pypiURL
+	pypiURL = srv.URL + "/pypi"
+	t.Cleanup(func() {
+		pypiURL = orig
+		srv.Close()
+	})
+}
+
+func TestHandleGetLatestErrors(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pypi/missing/json", func(rw http.ResponseWriter, req *http.Request) {
+		http.Error(rw, `{"message": "Not Found"}`, 404)
+	})
+	mux.HandleFunc("/pypi/empty/json", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(`{"info": {}, "releases": {}}`))
+	})
+	mux.HandleFunc("/pypi/broken/json", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(`<html>Service Unavailable</html>`))
+	})
+	testPyPI(t, mux)
+	for _, tc := range []struct {
+		query string
+		code  int
+		msg   string
+	}{
+		{"scope=pypi", 400, "Missing pkg parameter"},
+		{"scope=pypi&pkg=missing", 404, "Unknown package missing"},
+		{"scope=pypi&pkg=empty", 404, "Unknown package empty"},
+		{"scope=pypi&pkg=broken", 500, "Failed to resolve latest version"},
+	} {
+		rw := httptest.NewRecorder()
+		HandleGet(rw, httptest.NewRequest("GET", "/get?"+tc.query, nil))
+		if rw.Code != tc.code || strings.TrimSpace(rw.Body.String()) != tc.msg {
+			t.Errorf("GET /get?%s = (%d, %q), want (%d, %q)", tc.query, rw.Code, rw.Body.String(), tc.code, tc.msg)
+		}
+	}
+}